@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	// "path"
 
 	"github.com/chezzijr/p2p/internal/common/torrent"
@@ -13,6 +18,37 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// address of the control API of the running peer
+var addrFlag = &cli.StringFlag{
+    Name: "addr",
+    Value: peer.DefaultControlAddr,
+    Aliases: []string{"a"},
+    Usage: "Control API address",
+}
+
+var tokenFlag = &cli.StringFlag{
+    Name: "token-file",
+    Value: peer.DefaultControlTokenPath(),
+    Usage: "File with the token of the control API, created by the running peer",
+}
+
+func client(c *cli.Context) *peer.ControlClient {
+    // the peer refuses the requests without it, which tells what is wrong
+    token, err := peer.LoadControlToken(c.String("token-file"))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to read the control token: %s\n", err)
+    }
+    return peer.NewControlClient(c.String("addr"), token)
+}
+
+// the peer may run in another directory
+func absPath(p string) (string, error) {
+    if p == "" || strings.HasPrefix(p, "magnet:") {
+        return p, nil
+    }
+    return filepath.Abs(p)
+}
+
 func main() {
     app := &cli.App{
         Name: "chezzijr-p2p",
@@ -46,18 +82,33 @@ func main() {
                         Aliases: []string{"l"},
                         Usage: "Torrent files to leech",
                     },
+                    &cli.StringFlag{
+                        Name: "download-dir",
+                        Aliases: []string{"d"},
+                        Usage: "Directory to download to, the configured one if empty",
+                    },
+                    &cli.StringFlag{
+                        Name: "incomplete-dir",
+                        Usage: "Directory to keep downloads in until complete, the configured one if empty",
+                    },
+                    &cli.StringFlag{
+                        Name: "completed-dir",
+                        Usage: "Directory to move complete downloads to, the configured one if empty",
+                    },
                 },
                 Action: func(c *cli.Context) error {
                     port := c.Uint("port")
                     trackerUrl := c.String("tracker")
                     seedingFiles := c.StringSlice("seed")
                     leechingFiles := c.StringSlice("leech")
+                    downloadDir := c.String("download-dir")
 
                     p, err := peer.NewPeer(uint16(port))
                     if err != nil {
                         return err
                     }
                     defer p.Close()
+                    p.SetDataDirs(c.String("incomplete-dir"), c.String("completed-dir"))
 
                     for _, seedingFile := range seedingFiles {
                         t, err := torrent.GenerateTorrentFromSingleFile(seedingFile, trackerUrl, 1024)
@@ -79,7 +130,7 @@ func main() {
 
                     for _, leechingFile := range leechingFiles {
                         p.RegisterEvent(&peer.EventDownload{
-                            DownloadPath: "tests",
+                            DownloadPath: downloadDir,
                             TorrentPath: leechingFile,
                         })
                     }
@@ -113,6 +164,225 @@ func main() {
                     return nil
                 },
             },
+            {
+                Name: "add",
+                Usage: "Add a torrent file or magnet link to the running peer",
+                ArgsUsage: "<torrent>",
+                Flags: []cli.Flag{
+                    addrFlag,
+                    tokenFlag,
+                    &cli.StringFlag{
+                        Name: "path",
+                        Aliases: []string{"o"},
+                        Usage: "Directory to download to, the configured one if empty, or the data to seed",
+                    },
+                    &cli.BoolFlag{
+                        Name: "seed",
+                        Usage: "Seed existing data instead of downloading",
+                    },
+                    &cli.BoolFlag{
+                        Name: "super-seed",
+                        Usage: "Reveal the pieces one at a time when seeding",
+                    },
+                    &cli.BoolFlag{
+                        Name: "existing",
+                        Usage: "Verify existing data, seed its valid pieces and download the missing ones",
+                    },
+                    &cli.StringSliceFlag{
+                        Name: "cross-seed-dir",
+                        Usage: "Reuse the matching files found in the directory instead of downloading them",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected a torrent file or magnet link", 1)
+                    }
+                    torrentPath, err := absPath(c.Args().First())
+                    if err != nil {
+                        return err
+                    }
+                    dataPath, err := absPath(c.String("path"))
+                    if err != nil {
+                        return err
+                    }
+
+                    var crossSeedDirs []string
+                    for _, dir := range c.StringSlice("cross-seed-dir") {
+                        dir, err := absPath(dir)
+                        if err != nil {
+                            return err
+                        }
+                        crossSeedDirs = append(crossSeedDirs, dir)
+                    }
+
+                    infoHash, err := client(c).Add(peer.AddRequest{
+                        Torrent: torrentPath,
+                        Path: dataPath,
+                        Seed: c.Bool("seed"),
+                        SuperSeed: c.Bool("super-seed"),
+                        Existing: c.Bool("existing"),
+                        CrossSeedDirs: crossSeedDirs,
+                    })
+                    if err != nil {
+                        return err
+                    }
+                    fmt.Println(infoHash)
+                    return nil
+                },
+            },
+            {
+                Name: "ls",
+                Usage: "List the torrents of the running peer",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    statuses, err := client(c).List()
+                    if err != nil {
+                        return err
+                    }
+
+                    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+                    fmt.Fprintln(w, "INFO HASH\tNAME\tSTATE\tPROGRESS\tUP\tDOWN\tRATIO")
+                    for _, s := range statuses {
+                        state := s.State
+                        if s.Error != "" {
+                            state += ": " + s.Error
+                        }
+                        fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%d\t%d\t%.2f\n",
+                            s.InfoHash, s.Name, state, s.Progress*100, s.Uploaded, s.Downloaded, s.Ratio)
+                    }
+                    return w.Flush()
+                },
+            },
+            {
+                Name: "pause",
+                Usage: "Pause a torrent of the running peer",
+                ArgsUsage: "<info hash>",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected an info hash", 1)
+                    }
+                    return client(c).Pause(c.Args().First())
+                },
+            },
+            {
+                Name: "resume",
+                Usage: "Resume a paused torrent of the running peer",
+                ArgsUsage: "<info hash>",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected an info hash", 1)
+                    }
+                    return client(c).Resume(c.Args().First())
+                },
+            },
+            {
+                Name: "rm",
+                Usage: "Remove a torrent from the running peer",
+                ArgsUsage: "<info hash>",
+                Flags: []cli.Flag{
+                    addrFlag,
+                    tokenFlag,
+                    &cli.BoolFlag{
+                        Name: "delete-data",
+                        Usage: "Also delete the downloaded data",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected an info hash", 1)
+                    }
+                    return client(c).Remove(c.Args().First(), c.Bool("delete-data"))
+                },
+            },
+            {
+                Name: "mv",
+                Usage: "Move the data of a seeded torrent of the running peer",
+                ArgsUsage: "<info hash> <directory>",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 2 {
+                        return cli.Exit("Expected an info hash and a directory", 1)
+                    }
+                    dir, err := absPath(c.Args().Get(1))
+                    if err != nil {
+                        return err
+                    }
+                    return client(c).MoveStorage(c.Args().First(), dir)
+                },
+            },
+            {
+                Name: "files",
+                Usage: "List the files of a torrent of the running peer and where to stream them from",
+                ArgsUsage: "<info hash>",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected an info hash", 1)
+                    }
+                    cc := client(c)
+                    files, err := cc.Files(c.Args().First())
+                    if err != nil {
+                        return err
+                    }
+
+                    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+                    fmt.Fprintln(w, "INDEX\tLENGTH\tPATH\tURL")
+                    for _, f := range files {
+                        fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", f.Index, f.Length, f.Path, cc.FileURL(c.Args().First(), f.Index))
+                    }
+                    return w.Flush()
+                },
+            },
+            {
+                Name: "sequential",
+                Usage: "Download the pieces of a torrent of the running peer in order",
+                ArgsUsage: "<info hash>",
+                Flags: []cli.Flag{
+                    addrFlag,
+                    tokenFlag,
+                    &cli.BoolFlag{
+                        Name: "off",
+                        Usage: "Go back to the default order",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.NArg() != 1 {
+                        return cli.Exit("Expected an info hash", 1)
+                    }
+                    sequential := !c.Bool("off")
+                    return client(c).SetPriority(c.Args().First(), peer.PriorityRequest{Sequential: &sequential})
+                },
+            },
+            {
+                Name: "stats",
+                Usage: "Show the totals of the running peer",
+                Flags: []cli.Flag{addrFlag, tokenFlag},
+                Action: func(c *cli.Context) error {
+                    stats, err := client(c).Stats()
+                    if err != nil {
+                        return err
+                    }
+
+                    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+                    fmt.Fprintf(w, "Torrents:\t%d\n", stats.Torrents)
+                    states := make([]string, 0, len(stats.States))
+                    for state := range stats.States {
+                        states = append(states, state)
+                    }
+                    sort.Strings(states)
+                    for _, state := range states {
+                        fmt.Fprintf(w, "  %s:\t%d\n", state, stats.States[state])
+                    }
+                    fmt.Fprintf(w, "Connections:\t%d\n", stats.Connections)
+                    fmt.Fprintf(w, "Uploaded:\t%d (+%d overhead)\n", stats.Uploaded, stats.UploadedOverhead)
+                    fmt.Fprintf(w, "Downloaded:\t%d (+%d overhead)\n", stats.Downloaded, stats.DownloadedOverhead)
+                    fmt.Fprintf(w, "Upload limit:\t%d B/s\n", stats.UploadRate)
+                    fmt.Fprintf(w, "Download limit:\t%d B/s\n", stats.DownloadRate)
+                    return w.Flush()
+                },
+            },
         },
     }
 
@@ -9,18 +9,33 @@ var (
 	ErrInvalidProtocol = errors.New("invalid protocol")
 )
 
+// bit of the reserved bytes announcing the extension protocol, see BEP 10
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+)
+
 type Handshake struct {
 	Protocol string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// NewHandshake announces support for the extension protocol
 func NewHandshake(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Protocol: "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[extensionByte] |= extensionBit
+	return h
+}
+
+// SupportsExtensions reports whether the peer speaks the extension protocol
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[extensionByte]&extensionBit != 0
 }
 
 func (h *Handshake) Serialize() []byte {
@@ -34,7 +49,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Protocol))
 	curr := 1
 	curr += copy(buf[curr:], h.Protocol)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -58,13 +73,16 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Protocol: string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -21,6 +21,9 @@ const (
 	MsgCancel
 )
 
+// MsgExtended carries the messages of the extension protocol, see BEP 10
+const MsgExtended messageID = 20
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -142,3 +145,28 @@ func ParseRequestMsg(msg *Message) (index uint32, begin uint32, length uint32, e
 
 	return index, begin, length, nil
 }
+
+// BuildExtendedMsg wraps the payload of an extension message,
+// id 0 is the extended handshake
+func BuildExtendedMsg(id byte, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = id
+	copy(buf[1:], payload)
+
+	return &Message{
+		ID:      MsgExtended,
+		Payload: buf,
+	}
+}
+
+func ParseExtendedMsg(msg *Message) (byte, []byte, error) {
+	if msg == nil || msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Invalid message: %v", msg)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
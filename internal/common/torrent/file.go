@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"io"
 	"os"
@@ -144,3 +145,31 @@ func OpenFromReader(r io.Reader) (*TorrentFile, error) {
 func (t *TorrentFile) Write(w io.Writer) error {
 	return bencode.Marshal(w, t.toTorrentBencode())
 }
+
+// FromInfo builds the metainfo from the info dictionary fetched
+// for a magnet link, the info hash is the one of the raw dictionary
+func FromInfo(announce string, info []byte) (*TorrentFile, error) {
+	btf := torrentBencode{Announce: announce}
+	err := bencode.Unmarshal(bytes.NewReader(info), &btf.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := btf.toTorrentFile()
+	if err != nil {
+		return nil, err
+	}
+	t.InfoHash = sha1.Sum(info)
+	return t, nil
+}
+
+// InfoBytes returns the bencoded info dictionary,
+// which is what peers send each other for magnet links
+func (t *TorrentFile) InfoBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, t.toTorrentBencode().Info)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -22,13 +22,23 @@ var (
 	ErrMalformedPieces = errors.New("Received malformed pieces")
 )
 
+// A file of a multi-file torrent
+// Path is relative to the directory named after the torrent
+type File struct {
+	Length int      `json:"length"`
+	Path   []string `json:"path"`
+}
+
 type TorrentFile struct {
 	Announce    string     `json:"announce"`
 	InfoHash    Sha1Hash   `json:"info_hash"`
 	PieceHashes []Sha1Hash `json:"piece_hashes"`
 	PieceLength int        `json:"piece_length"`
-	Length      int        `json:"length"`
-	Name        string     `json:"name"`
+	// Total length of all files
+	Length int    `json:"length"`
+	Name   string `json:"name"`
+	// Empty for single file torrents
+	Files []File `json:"files,omitempty"`
 }
 
 type torrentBencode struct {
@@ -37,10 +47,16 @@ type torrentBencode struct {
 }
 
 type torrentBencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string               `bencode:"pieces"`
+	PieceLength int                  `bencode:"piece length"`
+	Length      int                  `bencode:"length,omitempty"`
+	Name        string               `bencode:"name"`
+	Files       []torrentBencodeFile `bencode:"files,omitempty"`
+}
+
+type torrentBencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 func (info *torrentBencodeInfo) hash() (Sha1Hash, error) {
@@ -76,13 +92,20 @@ func (btf *torrentBencode) toTorrentFile() (*TorrentFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	length := btf.Info.Length
+	var files []File
+	for _, f := range btf.Info.Files {
+		files = append(files, File{Length: f.Length, Path: f.Path})
+		length += f.Length
+	}
 	return &TorrentFile{
 		Announce:    btf.Announce,
 		InfoHash:    infoHash,
 		PieceHashes: pieceHashes,
 		PieceLength: btf.Info.PieceLength,
-		Length:      btf.Info.Length,
+		Length:      length,
 		Name:        btf.Info.Name,
+		Files:       files,
 	}, nil
 }
 
@@ -92,14 +115,23 @@ func (t *TorrentFile) toTorrentBencode() torrentBencode {
 		copy(hashBytes[i*20:], pieceHash[:])
 	}
 
+	info := torrentBencodeInfo{
+		Pieces:      string(hashBytes),
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+	}
+	// multi-file torrents have no length key
+	if t.IsMultiFile() {
+		info.Length = 0
+		for _, f := range t.Files {
+			info.Files = append(info.Files, torrentBencodeFile{Length: f.Length, Path: f.Path})
+		}
+	}
+
 	return torrentBencode{
 		Announce: t.Announce,
-		Info: torrentBencodeInfo{
-			Pieces:      string(hashBytes),
-			PieceLength: t.PieceLength,
-			Length:      t.Length,
-			Name:        t.Name,
-		},
+		Info:     info,
 	}
 }
 
@@ -107,3 +139,18 @@ func (t *TorrentFile) toTorrentBencode() torrentBencode {
 func (t *TorrentFile) NumPieces() int {
 	return len(t.PieceHashes)
 }
+
+func (t *TorrentFile) IsMultiFile() bool {
+	return len(t.Files) > 0
+}
+
+// PieceBounds returns the offsets of a piece within the torrent data,
+// the last piece might be shorter than the piece length
+func (t *TorrentFile) PieceBounds(index int) (int, int) {
+	begin := index * t.PieceLength
+	end := begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
+	}
+	return begin, end
+}
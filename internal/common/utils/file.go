@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"syscall"
 )
 
 func CreateFileIfNotExist(filePath string) error {
@@ -21,3 +26,129 @@ func CreateFileIfNotExist(filePath string) error {
     return err
 }
 
+
+// WriteFileAtomic replaces the file with the data, either completely or not at all
+// The data is written to a temporary file in the same directory, synced, then renamed
+func WriteFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+    dir := path.Dir(filePath)
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(dir, path.Base(filePath)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    // nothing to remove once renamed
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Chmod(perm); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), filePath); err != nil {
+        return err
+    }
+
+    // persist the rename, not supported everywhere
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    return nil
+}
+
+// MovePath moves a file or a directory, copying it when the destination is on another filesystem
+// The destination only appears once complete and the source is removed afterwards
+// An existing destination is never replaced, os.ErrExist is returned instead
+func MovePath(src, dst string) error {
+    if filepath.Clean(src) == filepath.Clean(dst) {
+        return nil
+    }
+    if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+        return err
+    }
+    if _, err := os.Lstat(dst); err == nil {
+        return &os.LinkError{Op: "move", Old: src, New: dst, Err: os.ErrExist}
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    err := os.Rename(src, dst)
+    if err == nil || !errors.Is(err, syscall.EXDEV) {
+        return err
+    }
+
+    tmp := dst + ".moving"
+    if err := os.RemoveAll(tmp); err != nil {
+        return err
+    }
+    if err := copyPath(src, tmp); err != nil {
+        os.RemoveAll(tmp)
+        return err
+    }
+    // the destination may have appeared during the copy
+    if _, err := os.Lstat(dst); err == nil {
+        os.RemoveAll(tmp)
+        return &os.LinkError{Op: "move", Old: src, New: dst, Err: os.ErrExist}
+    }
+    if err := os.Rename(tmp, dst); err != nil {
+        os.RemoveAll(tmp)
+        return err
+    }
+    return os.RemoveAll(src)
+}
+
+// copyPath copies a file or a directory tree, the files are synced
+func copyPath(src, dst string) error {
+    return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(src, p)
+        if err != nil {
+            return err
+        }
+        target := filepath.Join(dst, rel)
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        if d.IsDir() {
+            return os.MkdirAll(target, info.Mode().Perm())
+        }
+        return CopyFile(p, target, info.Mode().Perm())
+    })
+}
+
+// CopyFile copies a file and syncs the copy
+func CopyFile(src, dst string, perm os.FileMode) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    if err := out.Sync(); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
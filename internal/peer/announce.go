@@ -0,0 +1,62 @@
+package peer
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/api"
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// the tracker sends the interval as a time.Duration,
+// announcing more often than this is pointless
+const minAnnounceInterval = time.Minute
+
+// An unreachable tracker must not hold up the shutdown with the stopped announces
+var trackerClient = &http.Client{Timeout: 10 * time.Second}
+
+// periodic announces carry no event
+const announceRegular api.AnnounceEvent = ""
+
+// the handshake is the same size both ways
+var handshakeLen = int64(len(connection.NewHandshake([20]byte{}, [20]byte{}).Serialize()))
+
+func announceInterval(resp *api.AnnounceResponse) time.Duration {
+	return max(resp.Interval, minAnnounceInterval)
+}
+
+// bytesLeft is the size of the pieces missing from the bitfield,
+// the last piece may be shorter than the others
+func bytesLeft(tf *torrent.TorrentFile, bf connection.BitField) int {
+	left := 0
+	for i := 0; i < tf.NumPieces(); i++ {
+		if !bf.HasPiece(i) {
+			begin, end := tf.PieceBounds(i)
+			left += end - begin
+		}
+	}
+	return left
+}
+
+// announce reports the payload transferred for the torrent to the tracker
+func (p *Peer) announce(tf *torrent.TorrentFile, counters *torrentCounters, event api.AnnounceEvent, left int) (*api.AnnounceResponse, error) {
+	return p.updateToTracker(tf, event, int(counters.uploaded.Load()), int(counters.downloaded.Load()), left)
+}
+
+// announceLoop announces the torrent at every interval until the context is done
+func (p *Peer) announceLoop(ctx context.Context, tf *torrent.TorrentFile, counters *torrentCounters, interval time.Duration, left func() int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.announce(tf, counters, announceRegular, left()); err != nil {
+				logger.Error("Failed to announce", "error", err)
+			}
+		}
+	}
+}
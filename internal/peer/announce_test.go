@@ -0,0 +1,70 @@
+package peer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/api"
+	"github.com/chezzijr/p2p/internal/common/connection"
+)
+
+func TestBytesLeft(t *testing.T) {
+	// pieces of 4, 4 and 2 bytes
+	tf := testTorrent([]byte("0123456789"), 4)
+	bf := connection.NewBitField(tf.NumPieces())
+	if left := bytesLeft(tf, bf); left != 10 {
+		t.Errorf("Expected 10 bytes left, got %d", left)
+	}
+	bf.SetPiece(0)
+	if left := bytesLeft(tf, bf); left != 6 {
+		t.Errorf("Expected 6 bytes left, got %d", left)
+	}
+	bf.SetPiece(1)
+	if left := bytesLeft(tf, bf); left != 2 {
+		t.Errorf("Expected 2 bytes left, got %d", left)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	if wire, payload := splitMessage(nil); wire != 4 || payload != 0 {
+		t.Errorf("Expected a 4 bytes keep-alive, got %d %d", wire, payload)
+	}
+	piece := &connection.Message{ID: connection.MsgPiece, Payload: make([]byte, 8+100)}
+	if wire, payload := splitMessage(piece); wire != 113 || payload != 100 {
+		t.Errorf("Expected 113 bytes with 100 of payload, got %d %d", wire, payload)
+	}
+	have := connection.BuildHaveMsg(1)
+	if wire, payload := splitMessage(have); wire != 9 || payload != 0 {
+		t.Errorf("Expected 9 bytes without payload, got %d %d", wire, payload)
+	}
+}
+
+func TestAnnounceCounters(t *testing.T) {
+	tracker := newFakeTracker(t)
+	tf := testTorrent([]byte("0123456789"), 4)
+	tf.Announce = tracker.URL
+	p := &Peer{PeerID: [20]byte{1}, Port: 6881}
+
+	var counters torrentCounters
+	counters.uploaded.Store(1234)
+	counters.downloaded.Store(6)
+	counters.downloadedOverhead.Store(500)
+	resp, err := p.announce(tf, &counters, api.Started, 4)
+	if err != nil {
+		t.Fatalf("Failed to announce: %s", err)
+	}
+
+	q := tracker.lastAnnounce()
+	for key, want := range map[string]int{"uploaded": 1234, "downloaded": 6, "left": 4} {
+		if got, _ := strconv.Atoi(q.Get(key)); got != want {
+			t.Errorf("Expected %s=%d, got %s", key, want, q.Get(key))
+		}
+	}
+	if interval := announceInterval(resp); interval != minAnnounceInterval {
+		t.Errorf("Expected the interval to be clamped to %s, got %s", minAnnounceInterval, interval)
+	}
+	if interval := announceInterval(&api.AnnounceResponse{Interval: 15 * time.Minute}); interval != 15*time.Minute {
+		t.Errorf("Expected 15m, got %s", interval)
+	}
+}
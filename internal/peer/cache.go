@@ -1,15 +1,24 @@
 package peer
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
 	"github.com/chezzijr/p2p/internal/common/utils"
 )
 
+// Delay before a requested checkpoint, to save once for many pieces
+const checkpointDelay = 5 * time.Second
+
 // Used to keep track of the downloading files
 // When peer is gracefully shutdown, save the progress of the downloaded files to cache
 type CachedFile struct {
@@ -20,27 +29,107 @@ type CachedFile struct {
 
 	// Keep track of which pieces have been downloaded
 	Bitfield connection.BitField `json:"pieces"`
+
+	// Paused torrents are not started again when added
+	Paused bool `json:"paused,omitempty"`
+	// Set for seeds, the file is the complete data
+	Seeding bool `json:"seeding,omitempty"`
+	// Set for data given by the user, see addExisting, it is never moved
+	Existing bool `json:"existing,omitempty"`
+
+	// Bytes transferred and time seeding, over all sessions
+	Uploaded           int64         `json:"uploaded,omitempty"`
+	Downloaded         int64         `json:"downloaded,omitempty"`
+	UploadedOverhead   int64         `json:"uploaded_overhead,omitempty"`
+	DownloadedOverhead int64         `json:"downloaded_overhead,omitempty"`
+	SeedTime           time.Duration `json:"seed_time,omitempty"`
+	// Overrides of the global seed limits, see managedTorrent
+	RatioLimit    float64       `json:"ratio_limit,omitempty"`
+	SeedTimeLimit time.Duration `json:"seed_time_limit,omitempty"`
+	// Downloaded in order, see Peer.SetSequential
+	Sequential bool `json:"sequential,omitempty"`
+
+	// The bencoded metainfo, the torrent is restored from it when the peer starts again
+	Metainfo []byte `json:"metainfo,omitempty"`
+	// Directory the torrent is downloaded to, empty for seeds
+	DownloadPath string `json:"download_path,omitempty"`
+	SuperSeed    bool   `json:"super_seed,omitempty"`
+
+	// Fingerprint of the data when the cache was saved, to detect changes
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time,omitempty"`
 }
 
-// TODO: also cached the seeding files
-// so that next time the peer start, it can continue seeding the files
 type CachedFiles []*CachedFile
 type CachedFilesMap map[string]*CachedFile
 
-func (c CachedFilesMap) SaveCache(path string) error {
-	cachedFiles := make(CachedFiles, 0, len(c))
+// Version of the cache file, bumped with a migration on every incompatible change
+const cacheVersion = 2
+
+var ErrCacheVersion = errors.New("cache was saved by a newer version")
+
+type cacheDocument struct {
+	Version int         `json:"version"`
+	Files   CachedFiles `json:"files"`
+}
+
+// cacheMigrations[v] upgrades a cache document from version v to v+1
+var cacheMigrations = map[int]func(json.RawMessage) (json.RawMessage, error){
+	// version 1 was the bare list of files, without fingerprints
+	1: func(raw json.RawMessage) (json.RawMessage, error) {
+		return json.Marshal(struct {
+			Version int             `json:"version"`
+			Files   json.RawMessage `json:"files"`
+		}{2, raw})
+	},
+}
+
+// migrateCache upgrades a cache document to the current version
+func migrateCache(raw json.RawMessage) (json.RawMessage, error) {
+	version := 1
+	if raw[0] != '[' {
+		var header struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, err
+		}
+		version = header.Version
+	}
+	if version > cacheVersion {
+		return nil, fmt.Errorf("%w: %d", ErrCacheVersion, version)
+	}
+	for ; version < cacheVersion; version++ {
+		migrate, ok := cacheMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("No migration from cache version %d", version)
+		}
+		var err error
+		if raw, err = migrate(raw); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+func (c CachedFilesMap) encode() ([]byte, error) {
+	doc := cacheDocument{
+		Version: cacheVersion,
+		Files:   make(CachedFiles, 0, len(c)),
+	}
 	for _, cachedFile := range c {
-		cachedFiles = append(cachedFiles, cachedFile)
+		doc.Files = append(doc.Files, cachedFile)
 	}
+	return json.Marshal(doc)
+}
 
-	// Open the file at the given path
-	file, err := os.Create(path)
+// SaveCache replaces the cache file atomically, a crash leaves either the old or the new cache
+func (c CachedFilesMap) SaveCache(path string) error {
+	data, err := c.encode()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	return json.NewEncoder(file).Encode(cachedFiles)
+	return utils.WriteFileAtomic(path, data, 0644)
 }
 
 // the path is provided by the config
@@ -54,31 +143,269 @@ func LoadCache(path string) (CachedFilesMap, error) {
         return nil, err
     }
 
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
     if err != nil {
         return nil, err
     }
-	defer file.Close()
-
-	var cachedFiles CachedFiles
 
-    // If the file was newly created
-    // json decoder will return EOF error
+    // If the file was newly created it is empty
     // when gracefully shutdown, the cache will be saved
     // overwriting the file so we just return an empty map
-    err = json.NewDecoder(file).Decode(&cachedFiles)
+    data = bytes.TrimSpace(data)
+    if len(data) == 0 {
+        return make(CachedFilesMap), nil
+    }
+
+    data, err = migrateCache(data)
     if err != nil {
-        if errors.Is(err, io.EOF) {
-            return make(CachedFilesMap), nil
-        } else {
-            return nil, err
-        }
+        return nil, err
     }
+	var doc cacheDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
 
 	cachedFilesMap := make(CachedFilesMap)
-	for _, cachedFile := range cachedFiles {
+	for _, cachedFile := range doc.Files {
 		cachedFilesMap[cachedFile.InfoHash] = cachedFile
 	}
 
 	return cachedFilesMap, nil
 }
+
+// fingerprint is the total size and the latest modification time of the data,
+// a directory for multi-file torrents
+func fingerprint(path string) (int64, time.Time, error) {
+	var size int64
+	var modTime time.Time
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return size, modTime, err
+}
+
+// updateFingerprint records the state of the data the bitfield was saved with
+func (c *CachedFile) updateFingerprint() {
+	size, modTime, err := fingerprint(c.Filepath)
+	if err != nil {
+		c.Size, c.ModTime = 0, time.Time{}
+		return
+	}
+	c.Size, c.ModTime = size, modTime
+}
+
+// dataChanged reports whether the data was modified since the cache was saved,
+// e.g. by another program or by writes lost in a crash
+func (c *CachedFile) dataChanged() bool {
+	// saved without fingerprint
+	if c.ModTime.IsZero() {
+		return false
+	}
+	size, modTime, err := fingerprint(c.Filepath)
+	if err != nil {
+		return true
+	}
+	return size != c.Size || !modTime.Equal(c.ModTime)
+}
+
+// restoreTorrent loads the counters and limits of a torrent added again,
+// and reports whether it was paused
+func (p *Peer) restoreTorrent(mt *managedTorrent) bool {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	cache, ok := p.cache[mt.InfoHash.String()]
+	if !ok {
+		return false
+	}
+	mt.counters.uploaded.Store(cache.Uploaded)
+	mt.counters.downloaded.Store(cache.Downloaded)
+	mt.counters.uploadedOverhead.Store(cache.UploadedOverhead)
+	mt.counters.downloadedOverhead.Store(cache.DownloadedOverhead)
+	mt.mu.Lock()
+	mt.seedTime = cache.SeedTime
+	mt.ratioLimit = cache.RatioLimit
+	mt.seedTimeLimit = cache.SeedTimeLimit
+	mt.priority.sequential = cache.Sequential
+	mt.mu.Unlock()
+	return cache.Paused
+}
+
+// cachedFileLocked returns the cache entry of a torrent, creating it for seeds
+func (p *Peer) cachedFileLocked(mt *managedTorrent) *CachedFile {
+	cache, ok := p.cache[mt.InfoHash.String()]
+	if ok {
+		return cache
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	bitfield := connection.NewBitField(mt.NumPieces())
+	for i := 0; i < mt.NumPieces(); i++ {
+		bitfield.SetPiece(i)
+	}
+	cache = &CachedFile{
+		Filepath: mt.dataPath,
+		InfoHash: mt.InfoHash.String(),
+		Bitfield: bitfield,
+		Seeding:  true,
+	}
+	p.cache[mt.InfoHash.String()] = cache
+	return cache
+}
+
+// cacheTorrent records a torrent just added with its metainfo,
+// so that it is restored when the peer starts again
+func (p *Peer) cacheTorrent(mt *managedTorrent) error {
+	var metainfo bytes.Buffer
+	if err := mt.TorrentFile.Write(&metainfo); err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	seeding, superSeed, dir, dataPath := mt.seeding, mt.superSeed, mt.path, mt.dataPath
+	mt.mu.Unlock()
+	// the data of a download may already exist, see addExisting
+	if dataPath == "" {
+		dataPath = p.incompletePath(mt.TorrentFile, dir)
+	}
+
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	cache, ok := p.cache[mt.InfoHash.String()]
+	if !ok && seeding {
+		cache = p.cachedFileLocked(mt)
+	} else if !ok {
+		cache = &CachedFile{
+			Filepath: dataPath,
+			InfoHash: mt.InfoHash.String(),
+			Bitfield: connection.NewBitField(mt.NumPieces()),
+		}
+		p.cache[mt.InfoHash.String()] = cache
+	}
+	cache.Metainfo = metainfo.Bytes()
+	cache.SuperSeed = superSeed
+	if !seeding {
+		cache.DownloadPath = dir
+	}
+	return nil
+}
+
+// cacheSeed records a torrent that is now seeded from its complete data
+func (p *Peer) cacheSeed(mt *managedTorrent) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	cache := p.cachedFileLocked(mt)
+	mt.mu.Lock()
+	cache.Filepath = mt.dataPath
+	mt.mu.Unlock()
+	cache.Seeding = true
+}
+
+func (p *Peer) setCachedPaused(mt *managedTorrent, paused bool) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	if !paused {
+		if cache, ok := p.cache[mt.InfoHash.String()]; ok {
+			cache.Paused = false
+		}
+		return
+	}
+	p.cachedFileLocked(mt).Paused = true
+}
+
+func (p *Peer) forgetCached(infoHash torrent.Sha1Hash) (*CachedFile, bool) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	cache, ok := p.cache[infoHash.String()]
+	delete(p.cache, infoHash.String())
+	return cache, ok
+}
+
+// saveCache saves the cache with the current counters of the torrents
+func (p *Peer) saveCache() error {
+	// the latest snapshot is written last
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	// the pieces and fingerprints saved must match the data on disk
+	for _, mt := range p.torrents.list() {
+		if session := mt.getSession(); session != nil {
+			if err := session.commitPieces(); err != nil {
+				logger.Error("Failed to flush downloaded pieces", "infohash", mt.InfoHash.String(), "error", err)
+			}
+		}
+	}
+
+	now := time.Now()
+	p.cacheMu.Lock()
+	for _, mt := range p.torrents.list() {
+		cache, ok := p.cache[mt.InfoHash.String()]
+		if !ok {
+			continue
+		}
+		cache.Uploaded = mt.counters.uploaded.Load()
+		cache.Downloaded = mt.counters.downloaded.Load()
+		cache.UploadedOverhead = mt.counters.uploadedOverhead.Load()
+		cache.DownloadedOverhead = mt.counters.downloadedOverhead.Load()
+		mt.mu.Lock()
+		cache.SeedTime = mt.seedTimeLocked(now)
+		cache.RatioLimit = mt.ratioLimit
+		cache.SeedTimeLimit = mt.seedTimeLimit
+		cache.Sequential = mt.priority.sequential
+		mt.mu.Unlock()
+	}
+	for _, cache := range p.cache {
+		cache.updateFingerprint()
+	}
+	data, err := p.cache.encode()
+	p.cacheMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(p.config.CachePath, data, 0644)
+}
+
+// requestCheckpoint saves the cache soon, e.g. when a piece is completed
+func (p *Peer) requestCheckpoint() {
+	select {
+	case p.checkpoint <- struct{}{}:
+	default:
+	}
+}
+
+// checkpointLoop saves the cache periodically and when requested,
+// so that a crash loses little progress
+func (p *Peer) checkpointLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.checkpoint:
+			// pieces are often completed in bursts
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(checkpointDelay):
+			}
+		}
+		if err := p.saveCache(); err != nil {
+			logger.Error("Failed to save cache", "error", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+func TestLoadCacheMigratesV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	v1 := `[{"filepath":"/data/file.bin.tmp","infohash":"ab","pieces":"gA==","uploaded":7}]`
+	if err := os.WriteFile(path, []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := LoadCache(path)
+	if err != nil {
+		t.Fatalf("Failed to load version 1 cache: %s", err)
+	}
+	cf, ok := cache["ab"]
+	if !ok || cf.Filepath != "/data/file.bin.tmp" || cf.Uploaded != 7 || !cf.Bitfield.HasPiece(0) {
+		t.Fatalf("Expected the version 1 entry, got %+v", cf)
+	}
+
+	if err := cache.SaveCache(path); err != nil {
+		t.Fatalf("Failed to save cache: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc cacheDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Failed to decode saved cache: %s", err)
+	}
+	if doc.Version != cacheVersion || len(doc.Files) != 1 {
+		t.Errorf("Expected version %d with 1 file, got %+v", cacheVersion, doc)
+	}
+	// the temporary file is renamed
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("Expected no temporary files, got %v", matches)
+	}
+}
+
+func TestLoadCacheNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(path, []byte(`{"version":99,"files":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCache(path); !errors.Is(err, ErrCacheVersion) {
+		t.Errorf("Expected ErrCacheVersion, got %v", err)
+	}
+}
+
+func TestCachedFileDataChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cf := &CachedFile{Filepath: path, Bitfield: connection.NewBitField(3)}
+	if cf.dataChanged() {
+		t.Errorf("Expected no fingerprint to mean unchanged")
+	}
+
+	cf.updateFingerprint()
+	if cf.dataChanged() {
+		t.Errorf("Expected the data to be unchanged")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !cf.dataChanged() {
+		t.Errorf("Expected a new modification time to be a change")
+	}
+
+	cf.updateFingerprint()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !cf.dataChanged() {
+		t.Errorf("Expected deleted data to be a change")
+	}
+}
+
+var errNotFlushed = errors.New("not flushed")
+
+// unflushedData keeps its writes in memory until flushing is allowed
+type unflushedData struct {
+	storage.Torrent
+	allow bool
+}
+
+func (d *unflushedData) Flush() error {
+	if !d.allow {
+		return errNotFlushed
+	}
+	return d.Torrent.Flush()
+}
+
+func TestCheckpointFlushesPieces(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache.json")
+	data := []byte("0123456789")
+	tf := testTorrent(data, 4)
+	tf.InfoHash = torrent.Sha1Hash{0xf1}
+
+	p := newTestPeer(t, cachePath)
+	mt, err := p.torrents.add(tf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.cacheTorrent(mt); err != nil {
+		t.Fatal(err)
+	}
+	st, err := storage.NewMemoryStorage().Open(tf, "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unflushed := &unflushedData{Torrent: st}
+	session := &DownloadSession{
+		TorrentFile: tf,
+		peerInfo:    p,
+		data:        unflushed,
+		bitfield:    connection.NewBitField(tf.NumPieces()),
+		picker:      newPiecePicker(nil),
+		swarm:       newSwarm(tf, unflushed, p.PeerID, false),
+	}
+	mt.activate(StateDownloading, session.swarm, session)
+	if err := session.writePiece(&pieceResult{index: 0, buf: data[:4]}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := func() connection.BitField {
+		t.Helper()
+		if err := p.saveCache(); err != nil {
+			t.Fatalf("Failed to save cache: %s", err)
+		}
+		cache, err := LoadCache(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache[tf.InfoHash.String()].Bitfield
+	}
+	if saved().HasPiece(0) {
+		t.Errorf("Expected a piece that is not on disk not to be saved")
+	}
+	unflushed.allow = true
+	if !saved().HasPiece(0) {
+		t.Errorf("Expected the piece to be saved once flushed")
+	}
+}
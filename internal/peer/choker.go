@@ -0,0 +1,256 @@
+package peer
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rechokeInterval    = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	// a peer that has not sent us a piece for this long while
+	// we download from it is snubbing us
+	snubTimeout = time.Minute
+
+	defaultUploadSlots = 4
+)
+
+// Transfer statistics of a connection
+type remoteStats struct {
+	// payload bytes
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// unix nano of the last piece received from the peer
+	lastPiece atomic.Int64
+}
+
+func (rs *remoteStats) addDownloaded(n int, now time.Time) {
+	rs.downloaded.Add(int64(n))
+	rs.lastPiece.Store(now.UnixNano())
+}
+
+// chokeable is a connection the choker decides to upload to or not
+type chokeable interface {
+	Interested() bool
+	Choked() bool
+	Choke() error
+	Unchoke() error
+	// Seeding reports whether we have the whole torrent of the connection
+	Seeding() bool
+	Stats() *remoteStats
+}
+
+// choker implements the tit-for-tat choking algorithm across all connections:
+// the interested peers we download the most from (upload the most to when seeding)
+// get the upload slots, one of which is rotated between the other peers
+type choker struct {
+	clock Clock
+	slots int
+
+	mu         sync.Mutex
+	conns      map[chokeable]*chokeState
+	optimistic chokeable
+	lastRotate time.Time
+	nudge      chan struct{}
+}
+
+type chokeState struct {
+	// totals at the previous rechoke, used to compute the rates
+	downloaded int64
+	uploaded   int64
+	rate       float64
+	// when we unchoked the peer, used for snubbing
+	unchokedAt time.Time
+}
+
+func newChoker(clock Clock, slots int) *choker {
+	if slots < 1 {
+		slots = defaultUploadSlots
+	}
+	return &choker{
+		clock: clock,
+		slots: slots,
+		conns: make(map[chokeable]*chokeState),
+		nudge: make(chan struct{}, 1),
+	}
+}
+
+func (c *choker) add(conn chokeable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := conn.Stats()
+	c.conns[conn] = &chokeState{
+		downloaded: stats.downloaded.Load(),
+		uploaded:   stats.uploaded.Load(),
+	}
+}
+
+func (c *choker) remove(conn chokeable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+	if c.optimistic == conn {
+		c.optimistic = nil
+	}
+	c.reevaluate()
+}
+
+// reevaluate unchokes newly interested peers right away if a slot is free,
+// otherwise they wait for the next rechoke
+func (c *choker) reevaluate() {
+	select {
+	case c.nudge <- struct{}{}:
+	default:
+	}
+}
+
+func (c *choker) run(ctx context.Context) {
+	tick := c.clock.After(rechokeInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.nudge:
+			c.fillSlots()
+		case <-tick:
+			c.rechoke()
+			tick = c.clock.After(rechokeInterval)
+		}
+	}
+}
+
+func (c *choker) snubbed(conn chokeable, state *chokeState, now time.Time) bool {
+	if conn.Seeding() || state.unchokedAt.IsZero() {
+		return false
+	}
+	last := conn.Stats().lastPiece.Load()
+	since := state.unchokedAt
+	if last != 0 && time.Unix(0, last).After(since) {
+		since = time.Unix(0, last)
+	}
+	return now.Sub(since) > snubTimeout
+}
+
+func (c *choker) unchoke(conn chokeable, state *chokeState, now time.Time) {
+	if !conn.Choked() {
+		return
+	}
+	if err := conn.Unchoke(); err != nil {
+		logger.Error("Failed to unchoke", "error", err)
+		return
+	}
+	state.unchokedAt = now
+}
+
+func (c *choker) choke(conn chokeable, state *chokeState) {
+	if conn.Choked() {
+		return
+	}
+	if err := conn.Choke(); err != nil {
+		logger.Error("Failed to choke", "error", err)
+	}
+	state.unchokedAt = time.Time{}
+}
+
+// rechoke ranks the interested peers by rate and gives them the upload slots
+func (c *choker) rechoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	candidates := make([]chokeable, 0, len(c.conns))
+	for conn, state := range c.conns {
+		stats := conn.Stats()
+		downloaded, uploaded := stats.downloaded.Load(), stats.uploaded.Load()
+		if conn.Seeding() {
+			state.rate = float64(uploaded-state.uploaded) / rechokeInterval.Seconds()
+		} else {
+			state.rate = float64(downloaded-state.downloaded) / rechokeInterval.Seconds()
+		}
+		state.downloaded, state.uploaded = downloaded, uploaded
+
+		if conn.Interested() && !c.snubbed(conn, state, now) {
+			candidates = append(candidates, conn)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return c.conns[candidates[i]].rate > c.conns[candidates[j]].rate
+	})
+
+	// one slot is reserved for the optimistic unchoke
+	regular := candidates[:min(len(candidates), c.slots-1)]
+	unchoked := make(map[chokeable]bool, c.slots)
+	for _, conn := range regular {
+		unchoked[conn] = true
+	}
+
+	if c.optimistic == nil || unchoked[c.optimistic] || !c.optimistic.Interested() ||
+		now.Sub(c.lastRotate) >= optimisticInterval {
+		c.rotateOptimistic(unchoked, now)
+	}
+	if c.optimistic != nil {
+		unchoked[c.optimistic] = true
+	}
+
+	for conn, state := range c.conns {
+		if unchoked[conn] {
+			c.unchoke(conn, state, now)
+		} else {
+			c.choke(conn, state)
+		}
+	}
+}
+
+// rotateOptimistic picks a random interested peer that is not regularly unchoked,
+// snubbing peers are eligible so they get a chance to prove themselves
+func (c *choker) rotateOptimistic(unchoked map[chokeable]bool, now time.Time) {
+	var eligible []chokeable
+	for conn := range c.conns {
+		if conn.Interested() && !unchoked[conn] && conn != c.optimistic {
+			eligible = append(eligible, conn)
+		}
+	}
+	c.lastRotate = now
+	if len(eligible) == 0 {
+		// keep the current one if there is no one else
+		if c.optimistic != nil && (unchoked[c.optimistic] || !c.optimistic.Interested()) {
+			c.optimistic = nil
+		}
+		return
+	}
+	c.optimistic = eligible[rand.Intn(len(eligible))]
+}
+
+// fillSlots unchokes interested peers while there are free slots,
+// and chokes unchoked peers that lost interest
+func (c *choker) fillSlots() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	used := 0
+	for conn, state := range c.conns {
+		if conn.Choked() {
+			continue
+		}
+		if !conn.Interested() {
+			c.choke(conn, state)
+			continue
+		}
+		used++
+	}
+	for conn, state := range c.conns {
+		if used >= c.slots {
+			return
+		}
+		if conn.Choked() && conn.Interested() {
+			c.unchoke(conn, state, now)
+			used++
+		}
+	}
+}
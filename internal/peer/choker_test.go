@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeChokeable struct {
+	interested bool
+	choked     bool
+	seeding    bool
+	stats      remoteStats
+}
+
+func newFakeChokeable(interested bool) *fakeChokeable {
+	return &fakeChokeable{interested: interested, choked: true}
+}
+
+func (f *fakeChokeable) Interested() bool    { return f.interested }
+func (f *fakeChokeable) Choked() bool        { return f.choked }
+func (f *fakeChokeable) Choke() error        { f.choked = true; return nil }
+func (f *fakeChokeable) Unchoke() error      { f.choked = false; return nil }
+func (f *fakeChokeable) Seeding() bool       { return f.seeding }
+func (f *fakeChokeable) Stats() *remoteStats { return &f.stats }
+
+func countUnchoked(conns []*fakeChokeable) int {
+	n := 0
+	for _, c := range conns {
+		if !c.choked {
+			n++
+		}
+	}
+	return n
+}
+
+func TestChokerFillSlots(t *testing.T) {
+	c := newChoker(newFakeClock(at(0, 0, 0)), 2)
+	conns := []*fakeChokeable{newFakeChokeable(true), newFakeChokeable(false), newFakeChokeable(true), newFakeChokeable(true)}
+	for _, conn := range conns {
+		c.add(conn)
+	}
+
+	c.fillSlots()
+	if n := countUnchoked(conns); n != 2 {
+		t.Errorf("Expected 2 unchoked peers, got %d", n)
+	}
+	if !conns[1].choked {
+		t.Errorf("Expected uninterested peer to stay choked")
+	}
+}
+
+func TestChokerRechokePrefersFastPeers(t *testing.T) {
+	clock := newFakeClock(at(0, 0, 0))
+	c := newChoker(clock, 3)
+
+	conns := make([]*fakeChokeable, 5)
+	for i := range conns {
+		conns[i] = newFakeChokeable(true)
+		c.add(conns[i])
+	}
+
+	// conns 3 and 4 give us the most
+	for i, conn := range conns {
+		conn.stats.addDownloaded(i*1000, clock.Now())
+	}
+	clock.Advance(rechokeInterval)
+	c.rechoke()
+
+	if conns[3].choked || conns[4].choked {
+		t.Errorf("Expected the fastest peers to be unchoked")
+	}
+	if n := countUnchoked(conns); n != 3 {
+		t.Errorf("Expected 2 regular and 1 optimistic unchoke, got %d", n)
+	}
+	optimistic := c.optimistic
+	if optimistic == conns[3] || optimistic == conns[4] {
+		t.Errorf("Expected the optimistic unchoke to not be a regular one")
+	}
+
+	// the optimistic unchoke is kept until the rotation interval
+	conns[3].stats.addDownloaded(1000, clock.Now())
+	conns[4].stats.addDownloaded(1000, clock.Now())
+	clock.Advance(rechokeInterval)
+	c.rechoke()
+	if c.optimistic != optimistic {
+		t.Errorf("Expected optimistic unchoke to be kept before %s", optimisticInterval)
+	}
+}
+
+func TestChokerSeedingRanksByUpload(t *testing.T) {
+	clock := newFakeClock(at(0, 0, 0))
+	c := newChoker(clock, 2)
+
+	slow, fast := newFakeChokeable(true), newFakeChokeable(true)
+	slow.seeding, fast.seeding = true, true
+	c.add(slow)
+	c.add(fast)
+	// a third peer takes the optimistic slot
+	other := newFakeChokeable(true)
+	other.seeding = true
+	c.add(other)
+
+	slow.stats.uploaded.Add(10)
+	fast.stats.uploaded.Add(10000)
+	clock.Advance(rechokeInterval)
+	c.rechoke()
+
+	if fast.choked {
+		t.Errorf("Expected the peer we upload the most to to be unchoked")
+	}
+}
+
+func TestChokerAntiSnubbing(t *testing.T) {
+	clock := newFakeClock(at(0, 0, 0))
+	c := newChoker(clock, 2)
+
+	snubber := newFakeChokeable(true)
+	c.add(snubber)
+	c.fillSlots()
+	if snubber.choked {
+		t.Fatalf("Expected peer to be unchoked")
+	}
+
+	// nothing received for over a minute after being unchoked
+	clock.Advance(snubTimeout + time.Second)
+	if !c.snubbed(snubber, c.conns[snubber], clock.Now()) {
+		t.Errorf("Expected peer to be snubbing us")
+	}
+	snubber.stats.addDownloaded(1000, clock.Now().Add(-time.Second))
+	if c.snubbed(snubber, c.conns[snubber], clock.Now()) {
+		t.Errorf("Expected a recent piece to lift the snub")
+	}
+	clock.Advance(snubTimeout + time.Second)
+
+	fast, optimistic := newFakeChokeable(true), newFakeChokeable(true)
+	c.add(fast)
+	c.add(optimistic)
+	c.optimistic, c.lastRotate = optimistic, clock.Now()
+	fast.stats.addDownloaded(1000, clock.Now())
+	c.rechoke()
+
+	if !snubber.choked {
+		t.Errorf("Expected snubbing peer to lose its slot")
+	}
+	if fast.choked || optimistic.choked {
+		t.Errorf("Expected the other peers to be unchoked")
+	}
+}
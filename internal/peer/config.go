@@ -5,15 +5,17 @@ import (
 	"path"
 
 	"github.com/chezzijr/p2p/internal/common/utils"
+	"github.com/chezzijr/p2p/internal/peer/storage"
 	"github.com/spf13/viper"
 )
 
 const APPNAME = "chezzijr-p2p"
 
 var (
-    configPath string
-    cachePath  string
-    logPath    string
+    configPath   string
+    cachePath    string
+    logPath      string
+    downloadPath string
 )
 
 func init() {
@@ -33,6 +35,12 @@ func init() {
     cachePath = path.Join(cachePath, APPNAME)
 
     logPath = path.Join(os.TempDir(), APPNAME)
+
+    downloadPath, err = os.UserHomeDir()
+    if err != nil {
+        downloadPath = path.Join(os.TempDir(), APPNAME)
+    }
+    downloadPath = path.Join(downloadPath, "Downloads")
 }
 
 type Config struct {
@@ -40,8 +48,80 @@ type Config struct {
 	LogPath              string
 	DefaultBlockSize     int    
 	SeedOnFileDownloaded bool   
-	// This is hard to implement
+
+	// Where torrents are downloaded when no directory is given
+	DownloadDir string
+	// Where the data is written while downloading, the download directory if empty
+	IncompleteDir string
+	// Where the data is moved once downloaded, the download directory if empty
+	CompletedDir string
+	// Serve the verified pieces of a torrent while still downloading it
 	SeedOnPieceDownloaded bool
+
+	// Bandwidth limits in bytes per second, 0 means unlimited
+	MaxUploadRate          int
+	MaxDownloadRate        int
+	MaxTorrentUploadRate   int
+	MaxTorrentDownloadRate int
+
+	// Where the torrent data is stored: file, multifile, mmap or memory
+	StorageBackend string
+	// Disk I/O workers and caches, sizes in bytes
+	DiskIOWorkers      int
+	DiskWriteCacheSize int
+	DiskReadCacheSize  int
+	// Preallocation of downloaded files: none, sparse or full
+	Preallocation string
+
+	// Super-seed every torrent seeded from existing files
+	SuperSeeding bool
+
+	// Number of peers uploaded to at the same time, including the optimistic unchoke
+	UploadSlots int
+
+	// Torrents active at the same time, the others are queued, 0 for no limit
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
+	// Seeding stops once the share ratio or the minutes seeding reach these,
+	// 0 for no limit, torrents may override them
+	SeedRatioLimit float64
+	SeedTimeLimit  int
+	// What to do then: stop or remove
+	SeedLimitAction string
+
+	// Time of day overrides of the global limits, the first matching rule wins
+	Schedule []ScheduleRule
+
+	// Seconds between saves of the cache, it is also saved soon after
+	// a piece is downloaded, 0 to only save it on shutdown
+	CheckpointInterval int
+
+	// Hash the data of the torrents restored on start instead of
+	// trusting the pieces saved in the cache
+	VerifyOnRestore bool
+
+	// Pieces after the read cursor of a streamed torrent that are
+	// downloaded first, see Peer.SetStreaming
+	StreamWindow int
+
+	// New .torrent files in this directory are downloaded, empty to disable
+	WatchDir string
+	// Where the imported files are moved, the archive directory of WatchDir if empty
+	WatchArchiveDir string
+	// Where the imported torrents are downloaded
+	WatchDownloadDir string
+
+	// Loopback address of the control API, empty to disable it
+	ControlAddr string
+	// File with the token the clients of the control API must send,
+	// it is generated when missing
+	ControlTokenPath string
+}
+
+// DefaultControlTokenPath is where the token of the control API is kept by default
+func DefaultControlTokenPath() string {
+    return path.Join(configPath, "control.token")
 }
 
 func LoadConfig() (*Config, error) {
@@ -50,6 +130,8 @@ func LoadConfig() (*Config, error) {
 
 	viper.SetConfigName("config")
 	viper.SetConfigType("json")
+    // options missing from an existing config file get their default too
+    setDefaults()
 
 	if err := viper.ReadInConfig(); err != nil {
         if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -73,6 +155,22 @@ func LoadConfig() (*Config, error) {
 // So the error of ReadInConfig will not be ConfigFileNotFoundError
 func createDefaultConfig() error {
     configFilePath := path.Join(configPath, "config.json")
+    err := utils.CreateFileIfNotExist(configFilePath)
+    if err != nil {
+        return err
+    }
+
+    // write default config
+    err = viper.SafeWriteConfig()
+    if err != nil {
+        return err
+    }
+
+    err = viper.ReadInConfig()
+    return err
+}
+
+func setDefaults() {
     cacheFilePath := path.Join(cachePath, "cache.json")
     logFilePath := path.Join(logPath, "log.txt")
 
@@ -81,7 +179,31 @@ func createDefaultConfig() error {
         LogPath:              logFilePath,
         DefaultBlockSize:     1024,
         SeedOnFileDownloaded: true,
+        DownloadDir:          downloadPath,
+        IncompleteDir:        "",
+        CompletedDir:         "",
         SeedOnPieceDownloaded: false,
+        StorageBackend:       storage.BackendFile,
+        DiskIOWorkers:        4,
+        DiskWriteCacheSize:   16 * 1024 * 1024,
+        DiskReadCacheSize:    32 * 1024 * 1024,
+        Preallocation:        storage.PreallocateSparse,
+        SuperSeeding:         false,
+        UploadSlots:          defaultUploadSlots,
+        MaxActiveDownloads:   3,
+        MaxActiveSeeds:       5,
+        SeedRatioLimit:       0,
+        SeedTimeLimit:        0,
+        SeedLimitAction:      SeedLimitStop,
+        Schedule:             []ScheduleRule{},
+        CheckpointInterval:   60,
+        VerifyOnRestore:      false,
+        StreamWindow:         defaultStreamWindow,
+        WatchDir:             "",
+        WatchArchiveDir:      "",
+        WatchDownloadDir:     "",
+        ControlAddr:          DefaultControlAddr,
+        ControlTokenPath:     DefaultControlTokenPath(),
     }
 
     viper.SetDefault("CachePath", defaultCfg.CachePath)
@@ -89,18 +211,32 @@ func createDefaultConfig() error {
     viper.SetDefault("DefaultBlockSize", defaultCfg.DefaultBlockSize)
     viper.SetDefault("SeedOnFileDownloaded", defaultCfg.SeedOnFileDownloaded)
     viper.SetDefault("SeedOnPieceDownloaded", defaultCfg.SeedOnPieceDownloaded)
-
-    err := utils.CreateFileIfNotExist(configFilePath)
-    if err != nil {
-        return err
-    }
-
-    // write default config
-    err = viper.SafeWriteConfig()
-    if err != nil {
-        return err
-    }
-
-    err = viper.ReadInConfig()
-    return err
+    viper.SetDefault("DownloadDir", defaultCfg.DownloadDir)
+    viper.SetDefault("IncompleteDir", defaultCfg.IncompleteDir)
+    viper.SetDefault("CompletedDir", defaultCfg.CompletedDir)
+    viper.SetDefault("MaxUploadRate", defaultCfg.MaxUploadRate)
+    viper.SetDefault("MaxDownloadRate", defaultCfg.MaxDownloadRate)
+    viper.SetDefault("MaxTorrentUploadRate", defaultCfg.MaxTorrentUploadRate)
+    viper.SetDefault("MaxTorrentDownloadRate", defaultCfg.MaxTorrentDownloadRate)
+    viper.SetDefault("StorageBackend", defaultCfg.StorageBackend)
+    viper.SetDefault("DiskIOWorkers", defaultCfg.DiskIOWorkers)
+    viper.SetDefault("DiskWriteCacheSize", defaultCfg.DiskWriteCacheSize)
+    viper.SetDefault("DiskReadCacheSize", defaultCfg.DiskReadCacheSize)
+    viper.SetDefault("Preallocation", defaultCfg.Preallocation)
+    viper.SetDefault("SuperSeeding", defaultCfg.SuperSeeding)
+    viper.SetDefault("UploadSlots", defaultCfg.UploadSlots)
+    viper.SetDefault("MaxActiveDownloads", defaultCfg.MaxActiveDownloads)
+    viper.SetDefault("MaxActiveSeeds", defaultCfg.MaxActiveSeeds)
+    viper.SetDefault("SeedRatioLimit", defaultCfg.SeedRatioLimit)
+    viper.SetDefault("SeedTimeLimit", defaultCfg.SeedTimeLimit)
+    viper.SetDefault("SeedLimitAction", defaultCfg.SeedLimitAction)
+    viper.SetDefault("Schedule", defaultCfg.Schedule)
+    viper.SetDefault("CheckpointInterval", defaultCfg.CheckpointInterval)
+    viper.SetDefault("VerifyOnRestore", defaultCfg.VerifyOnRestore)
+    viper.SetDefault("StreamWindow", defaultCfg.StreamWindow)
+    viper.SetDefault("WatchDir", defaultCfg.WatchDir)
+    viper.SetDefault("WatchArchiveDir", defaultCfg.WatchArchiveDir)
+    viper.SetDefault("WatchDownloadDir", defaultCfg.WatchDownloadDir)
+    viper.SetDefault("ControlAddr", defaultCfg.ControlAddr)
+    viper.SetDefault("ControlTokenPath", defaultCfg.ControlTokenPath)
 }
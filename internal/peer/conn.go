@@ -0,0 +1,385 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+)
+
+var (
+	ErrConnClosed    = errors.New("connection closed")
+	ErrDuplicateConn = errors.New("already connected to peer")
+	ErrSelfConn      = errors.New("connected to ourselves")
+)
+
+// Requests queued beyond this are dropped, peers are expected
+// to keep a small backlog of requests
+const maxQueuedRequests = 64
+
+// A remote peer not reading this many queued messages, e.g. the haves
+// of a fast download, is disconnected instead of growing the queue
+const maxQueuedMessages = 1024
+
+// PeerConn is the single connection with a remote peer for a torrent,
+// both peers download from and upload to each other over it.
+// The read loop dispatches the incoming messages to the download and
+// upload logic, every outgoing message goes through the write loop.
+type PeerConn struct {
+	conn     net.Conn
+	swarm    *swarm
+	choker   *choker
+	RemoteID [20]byte
+	// the dialed address of outbound connections
+	addr string
+	// whether the remote peer speaks the extension protocol
+	extensions bool
+
+	// the outgoing messages, sending never blocks
+	qmu          sync.Mutex
+	queue        []*connection.Message
+	queuedPieces int
+	queued       chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// choke and interest states of both sides
+	stateMu      sync.Mutex
+	amChoking    bool
+	amInterested bool
+	peerChoking  bool
+	peerInterest bool
+	// times the remote peer choked us
+	chokeCount int
+	// pieces of the remote peer
+	bitfield connection.BitField
+	// id the remote peer receives ut_metadata messages with, 0 if it does not
+	metadataID byte
+
+	// piece messages for the downloader
+	blocks chan *connection.Message
+	// signaled when the remote peer chokes, unchokes or gets new pieces
+	wake  chan struct{}
+	stats remoteStats
+}
+
+func newPeerConn(conn net.Conn, sw *swarm, remoteID [20]byte, addr string, c *choker) *PeerConn {
+	return &PeerConn{
+		conn:        conn,
+		swarm:       sw,
+		choker:      c,
+		RemoteID:    remoteID,
+		addr:        addr,
+		queued:      make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+		amChoking:   true,
+		peerChoking: true,
+		bitfield:    connection.NewBitField(sw.NumPieces()),
+		// requests are bounded by the backlog
+		blocks: make(chan *connection.Message, 2*MaxBacklog),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Outbound reports whether we dialed the remote peer
+func (pc *PeerConn) Outbound() bool {
+	return pc.addr != ""
+}
+
+// run blocks until the connection is closed
+func (pc *PeerConn) run() {
+	defer pc.Close()
+
+	pc.choker.add(pc)
+	go pc.writeLoop()
+	pc.swarm.counters.uploadedOverhead.Add(handshakeLen)
+	pc.swarm.counters.downloadedOverhead.Add(handshakeLen)
+
+	// both sides start with their bitfield
+	pc.send(&connection.Message{
+		ID:      connection.MsgBitfield,
+		Payload: pc.swarm.advertisedBitfield(),
+	})
+	if pc.extensions {
+		pc.sendExtHandshake()
+	}
+	if ss := pc.swarm.superSeed; ss != nil {
+		if piece, ok := ss.add(pc); ok {
+			pc.sendHave(piece)
+		}
+	}
+
+	pc.readLoop()
+}
+
+func (pc *PeerConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.conn.Close()
+		pc.swarm.remove(pc)
+		pc.choker.remove(pc)
+		if ss := pc.swarm.superSeed; ss != nil {
+			ss.remove(pc)
+		}
+	})
+	return nil
+}
+
+// send queues a message for the write loop
+func (pc *PeerConn) send(msg *connection.Message) {
+	pc.qmu.Lock()
+	if len(pc.queue) >= maxQueuedMessages {
+		pc.qmu.Unlock()
+		// send may be called with the swarm or choker locked, closing the
+		// connection ends both loops and run closes the rest
+		logger.Debug("Dropping a peer not reading its messages", "queued", maxQueuedMessages)
+		pc.conn.Close()
+		return
+	}
+	pc.queue = append(pc.queue, msg)
+	if msg != nil && msg.ID == connection.MsgPiece {
+		pc.queuedPieces++
+	}
+	pc.qmu.Unlock()
+
+	select {
+	case pc.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (pc *PeerConn) writeLoop() {
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-pc.queued:
+		}
+
+		pc.qmu.Lock()
+		queue := pc.queue
+		pc.queue = nil
+		pc.qmu.Unlock()
+
+		for _, msg := range queue {
+			if _, err := pc.conn.Write(msg.Serialize()); err != nil {
+				logConnError("Failed to write message", err)
+				pc.Close()
+				return
+			}
+			pc.countWritten(msg)
+			if msg != nil && msg.ID == connection.MsgPiece {
+				pc.qmu.Lock()
+				pc.queuedPieces--
+				pc.qmu.Unlock()
+			}
+		}
+	}
+}
+
+func (pc *PeerConn) readLoop() {
+	for {
+		msg, err := connection.ReadMsg(pc.conn)
+		if err != nil {
+			logConnError("Failed to read message", err)
+			return
+		}
+		pc.countRead(msg)
+		if msg == nil { // keep-alive
+			continue
+		}
+		pc.handleMessage(msg)
+	}
+}
+
+// splitMessage returns the size of a message on the wire and how much of it is payload
+func splitMessage(msg *connection.Message) (wire, payload int64) {
+	if msg == nil { // keep-alive
+		return 4, 0
+	}
+	wire = int64(5 + len(msg.Payload))
+	if msg.ID == connection.MsgPiece && len(msg.Payload) > 8 {
+		payload = int64(len(msg.Payload) - 8)
+	}
+	return wire, payload
+}
+
+func (pc *PeerConn) countRead(msg *connection.Message) {
+	wire, payload := splitMessage(msg)
+	pc.swarm.counters.downloaded.Add(payload)
+	pc.swarm.counters.downloadedOverhead.Add(wire - payload)
+	if payload > 0 {
+		pc.stats.addDownloaded(int(payload), time.Now())
+	}
+}
+
+func (pc *PeerConn) countWritten(msg *connection.Message) {
+	wire, payload := splitMessage(msg)
+	pc.swarm.counters.uploaded.Add(payload)
+	pc.swarm.counters.uploadedOverhead.Add(wire - payload)
+	pc.stats.uploaded.Add(payload)
+}
+
+// logConnError logs unexpected errors, a closed connection is expected
+func logConnError(msg string, err error) {
+	switch errNet, ok := err.(net.Error); {
+	case errors.Is(err, net.ErrClosed),
+		errors.Is(err, io.EOF),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, context.Canceled):
+		logger.Debug("Connection closed")
+	case ok && errNet.Timeout():
+		logger.Info("Connection timeout")
+	default:
+		logger.Error(msg, "error", err)
+	}
+}
+
+// handleMessage updates the state of the connection and
+// dispatches the message to the download or upload logic
+func (pc *PeerConn) handleMessage(msg *connection.Message) {
+	switch msg.ID {
+	case connection.MsgChoke:
+		pc.stateMu.Lock()
+		pc.peerChoking = true
+		pc.chokeCount++
+		pc.stateMu.Unlock()
+		pc.notify()
+	case connection.MsgUnchoke:
+		pc.stateMu.Lock()
+		pc.peerChoking = false
+		pc.stateMu.Unlock()
+		pc.notify()
+	case connection.MsgInterested:
+		pc.stateMu.Lock()
+		pc.peerInterest = true
+		pc.stateMu.Unlock()
+		pc.choker.reevaluate()
+	case connection.MsgNotInterested:
+		pc.stateMu.Lock()
+		pc.peerInterest = false
+		pc.stateMu.Unlock()
+		pc.choker.reevaluate()
+	case connection.MsgHave:
+		index, err := connection.ParseHaveMsg(msg)
+		if err != nil {
+			return
+		}
+		pc.stateMu.Lock()
+		pc.bitfield.SetPiece(index)
+		pc.stateMu.Unlock()
+		pc.notify()
+		if ss := pc.swarm.superSeed; ss != nil {
+			for _, offer := range ss.have(pc, index) {
+				offer.conn.sendHave(offer.piece)
+			}
+		}
+	case connection.MsgBitfield:
+		pc.stateMu.Lock()
+		copy(pc.bitfield, msg.Payload)
+		pc.stateMu.Unlock()
+		pc.notify()
+	case connection.MsgRequest:
+		pc.handleRequest(msg)
+	case connection.MsgExtended:
+		pc.handleExtended(msg)
+	case connection.MsgPiece:
+		// blocks nobody waits for anymore are dropped
+		select {
+		case pc.blocks <- msg:
+		default:
+		}
+	}
+}
+
+// notify wakes up the downloader waiting on the connection
+func (pc *PeerConn) notify() {
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (pc *PeerConn) HasPiece(index int) bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.bitfield.HasPiece(index)
+}
+
+// PeerChoking reports whether the remote peer chokes us,
+// and how many times it did so to detect dropped requests
+func (pc *PeerConn) PeerChoking() (bool, int) {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.peerChoking, pc.chokeCount
+}
+
+// SetInterested tells the remote peer whether we want to download from it
+func (pc *PeerConn) SetInterested(interested bool) {
+	pc.stateMu.Lock()
+	changed := pc.amInterested != interested
+	pc.amInterested = interested
+	pc.stateMu.Unlock()
+
+	if !changed {
+		return
+	}
+	if interested {
+		pc.send(&connection.Message{ID: connection.MsgInterested})
+	} else {
+		pc.send(&connection.Message{ID: connection.MsgNotInterested})
+	}
+}
+
+func (pc *PeerConn) sendRequest(index, begin, length int) {
+	pc.send(connection.BuildRequestMsg(uint32(index), uint32(begin), uint32(length)))
+}
+
+func (pc *PeerConn) sendHave(index int) {
+	pc.send(connection.BuildHaveMsg(index))
+}
+
+// Interested reports whether the remote peer wants to download from us,
+// which is never the case when we do not upload the torrent
+func (pc *PeerConn) Interested() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.peerInterest && pc.swarm.upload
+}
+
+func (pc *PeerConn) Choked() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.amChoking
+}
+
+func (pc *PeerConn) Choke() error {
+	pc.stateMu.Lock()
+	pc.amChoking = true
+	pc.stateMu.Unlock()
+	pc.send(&connection.Message{ID: connection.MsgChoke})
+	return nil
+}
+
+func (pc *PeerConn) Unchoke() error {
+	pc.stateMu.Lock()
+	pc.amChoking = false
+	pc.stateMu.Unlock()
+	pc.send(&connection.Message{ID: connection.MsgUnchoke})
+	return nil
+}
+
+func (pc *PeerConn) Seeding() bool {
+	return pc.swarm.data.Completed().NumPieces() == pc.swarm.NumPieces()
+}
+
+func (pc *PeerConn) Stats() *remoteStats {
+	return &pc.stats
+}
@@ -0,0 +1,282 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+func init() {
+	InitLogger(io.Discard)
+}
+
+func testTorrent(data []byte, pieceLength int) *torrent.TorrentFile {
+	tf := &torrent.TorrentFile{
+		Name:        "file.bin",
+		PieceLength: pieceLength,
+		Length:      len(data),
+	}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := min(begin+pieceLength, len(data))
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+	return tf
+}
+
+func testSwarm(t *testing.T, tf *torrent.TorrentFile, id byte, data []byte) *swarm {
+	t.Helper()
+	st, err := storage.NewMemoryStorage().Open(tf, "file.bin")
+	if err != nil {
+		t.Fatalf("Failed to open storage: %s", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	if data != nil {
+		for i := 0; i < tf.NumPieces(); i++ {
+			begin, end := tf.PieceBounds(i)
+			st.WriteAt(data[begin:end], i, 0)
+			st.MarkComplete(i)
+		}
+	}
+	return newSwarm(tf, st, [20]byte{id}, data != nil)
+}
+
+func TestPeerConnDownload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	tf := testTorrent(data, 3*MaxBlockSize)
+	seeder := testSwarm(t, tf, 1, data)
+	leecher := testSwarm(t, tf, 2, nil)
+
+	seederChoker := newChoker(realClock{}, 1)
+	go seederChoker.run(ctx)
+	leecherChoker := newChoker(realClock{}, 1)
+	go leecherChoker.run(ctx)
+
+	a, b := net.Pipe()
+	sc := newPeerConn(a, seeder, [20]byte{2}, "", seederChoker)
+	lc := newPeerConn(b, leecher, [20]byte{1}, "seeder:6881", leecherChoker)
+	seeder.add(sc)
+	leecher.add(lc)
+	go sc.run()
+	go lc.run()
+
+	lc.SetInterested(true)
+	for i := 0; i < tf.NumPieces(); i++ {
+		begin, end := tf.PieceBounds(i)
+		pi := &pieceInfo{index: i, hash: tf.PieceHashes[i], length: end - begin}
+		buf, err := attemptDownloadPiece(ctx, lc, pi)
+		if err != nil {
+			t.Fatalf("Failed to download piece %d: %s", i, err)
+		}
+		if err := checkIntegrity(buf, pi); err != nil {
+			t.Errorf("Expected piece %d to be valid, got %s", i, err)
+		}
+	}
+
+	if !lc.HasPiece(tf.NumPieces() - 1) {
+		t.Errorf("Expected the bitfield of the seeder")
+	}
+	// the leecher does not upload, so it never unchokes the seeder
+	if lc.Interested() || !lc.Choked() {
+		t.Errorf("Expected the leecher not to upload")
+	}
+	if n := lc.Stats().downloaded.Load(); n != int64(len(data)) {
+		t.Errorf("Expected %d downloaded bytes, got %d", len(data), n)
+	}
+	if n := leecher.counters.downloaded.Load(); n != int64(len(data)) {
+		t.Errorf("Expected %d downloaded payload bytes, got %d", len(data), n)
+	}
+	// the bitfield, unchoke and piece headers
+	if n := leecher.counters.downloadedOverhead.Load(); n < handshakeLen+int64(tf.NumPieces())*13 {
+		t.Errorf("Expected the protocol overhead to be counted, got %d", n)
+	}
+	// uploads are counted once written
+	deadline := time.Now().Add(time.Second)
+	for seeder.counters.uploaded.Load() < int64(len(data)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	lc.Close()
+	if n := sc.Stats().uploaded.Load(); n != int64(len(data)) {
+		t.Errorf("Expected %d uploaded bytes, got %d", len(data), n)
+	}
+	if n := seeder.counters.uploaded.Load(); n != int64(len(data)) {
+		t.Errorf("Expected %d uploaded payload bytes, got %d", len(data), n)
+	}
+}
+
+func TestSwarmDuplicateConn(t *testing.T) {
+	tf := testTorrent([]byte("0123456789"), 4)
+	c := newChoker(realClock{}, 1)
+
+	// we are peer 2 and connected to peer 1 both ways,
+	// peer 1 opened the inbound connection and has the lower ID
+	sw := testSwarm(t, tf, 2, nil)
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	outbound := newPeerConn(a, sw, [20]byte{1}, "peer1:6881", c)
+	inbound := newPeerConn(b, sw, [20]byte{1}, "", c)
+
+	if err := sw.add(outbound); err != nil {
+		t.Fatalf("Expected the first connection to be added, got %s", err)
+	}
+	if err := sw.add(inbound); err != nil {
+		t.Fatalf("Expected the inbound connection to replace the outbound one, got %s", err)
+	}
+	select {
+	case <-outbound.closed:
+	default:
+		t.Errorf("Expected the outbound connection to be closed")
+	}
+	if sw.conns[[20]byte{1}] != inbound {
+		t.Errorf("Expected the inbound connection to be kept")
+	}
+
+	// peer 1 keeps the same connection
+	sw = testSwarm(t, tf, 1, nil)
+	a, _ = net.Pipe()
+	b, _ = net.Pipe()
+	outbound = newPeerConn(a, sw, [20]byte{2}, "peer2:6881", c)
+	inbound = newPeerConn(b, sw, [20]byte{2}, "", c)
+	sw.add(outbound)
+	if err := sw.add(inbound); err != ErrDuplicateConn {
+		t.Errorf("Expected ErrDuplicateConn, got %v", err)
+	}
+	if sw.conns[[20]byte{2}] != outbound {
+		t.Errorf("Expected the outbound connection to be kept")
+	}
+}
+
+func TestPeerConnQueueLimit(t *testing.T) {
+	tf := testTorrent([]byte("0123456789"), 4)
+	sw := testSwarm(t, tf, 1, nil)
+	a, b := net.Pipe()
+	defer b.Close()
+	// the write loop is not running, nothing is read
+	pc := newPeerConn(a, sw, [20]byte{2}, "", newChoker(realClock{}, 1))
+	for i := 0; i < maxQueuedMessages; i++ {
+		pc.sendHave(i % tf.NumPieces())
+	}
+
+	pc.sendHave(0)
+	if n := len(pc.queue); n != maxQueuedMessages {
+		t.Errorf("Expected %d queued messages, got %d", maxQueuedMessages, n)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// readMsg reads the next message from the remote side, skipping keep-alives
+func readMsg(t *testing.T, conn net.Conn) *connection.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := connection.ReadMsg(conn)
+		if err != nil {
+			t.Fatalf("Failed to read message: %s", err)
+		}
+		if msg != nil {
+			return msg
+		}
+	}
+}
+
+// expectNoMsg checks that nothing is sent for a while
+func expectNoMsg(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if msg, err := connection.ReadMsg(conn); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	}
+}
+
+func TestSeedWhileDownloading(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	tf := testTorrent(data, 4)
+	piece := func(i int) []byte {
+		begin, end := tf.PieceBounds(i)
+		return data[begin:end]
+	}
+
+	for _, upload := range []bool{true, false} {
+		st, err := storage.NewMemoryStorage().Open(tf, "file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.WriteAt(piece(0), 0, 0)
+		st.MarkComplete(0)
+		// as built by runDownload with SeedOnPieceDownloaded
+		sw := newSwarm(tf, st, [20]byte{1}, upload)
+		ds := &DownloadSession{
+			TorrentFile: tf,
+			peerInfo:    newTestPeer(t, filepath.Join(t.TempDir(), "cache.json")),
+			data:        st,
+			swarm:       sw,
+			bitfield:    connection.NewBitField(tf.NumPieces()),
+		}
+
+		a, b := net.Pipe()
+		defer b.Close()
+		pc := newPeerConn(a, sw, [20]byte{2}, "", newChoker(realClock{}, 1))
+		sw.add(pc)
+		go pc.run()
+
+		// only the completed pieces are advertised
+		msg := readMsg(t, b)
+		if msg.ID != connection.MsgBitfield {
+			t.Fatalf("Expected the bitfield first, got %d", msg.ID)
+		}
+		bf := connection.BitField(msg.Payload)
+		if bf.HasPiece(0) != upload || bf.HasPiece(1) || bf.HasPiece(3) {
+			t.Errorf("Expected only the first piece advertised when uploading (%v), got %08b", upload, bf)
+		}
+
+		pc.Unchoke()
+		if msg := readMsg(t, b); msg.ID != connection.MsgUnchoke {
+			t.Fatalf("Expected an unchoke, got %d", msg.ID)
+		}
+
+		// a verified piece is announced to the connected peers
+		if err := ds.writePiece(&pieceResult{index: 1, buf: piece(1)}); err != nil {
+			t.Fatal(err)
+		}
+		if upload {
+			msg := readMsg(t, b)
+			if index, err := connection.ParseHaveMsg(msg); err != nil || index != 1 {
+				t.Errorf("Expected a have for piece 1, got %+v (%v)", msg, err)
+			}
+		}
+
+		// a missing piece is refused and the connection stays up
+		if _, err := pc.getPiece(2, 0, 4); err != ErrPieceNotFound {
+			t.Errorf("Expected ErrPieceNotFound, got %v", err)
+		}
+		b.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		b.Write(connection.BuildRequestMsg(2, 0, 4).Serialize())
+		b.Write(connection.BuildRequestMsg(1, 0, 4).Serialize())
+		if !upload {
+			expectNoMsg(t, b)
+			continue
+		}
+		msg = readMsg(t, b)
+		if msg.ID != connection.MsgPiece || !bytes.Equal(msg.Payload[8:], piece(1)) {
+			t.Errorf("Expected piece 1, got %+v", msg)
+		}
+		if index := binary.BigEndian.Uint32(msg.Payload[0:4]); index != 1 {
+			t.Errorf("Expected the missing piece not to be sent, got piece %d", index)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package peer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/common/utils"
+)
+
+// The control API lets local clients manage a running peer,
+// it is JSON over HTTP and only listens on the loopback interface
+// Requests must carry the token of the peer, which only the user can read,
+// so that web pages and other users of the host cannot use it
+
+const DefaultControlAddr = "127.0.0.1:6880"
+
+// how long a client may take to send the headers of a request
+const controlReadHeaderTimeout = 10 * time.Second
+
+var (
+	ErrControlNotLoopback = errors.New("control API must listen on a loopback address")
+	ErrInvalidInfoHash    = errors.New("invalid info hash")
+	ErrInvalidMagnet      = errors.New("invalid magnet link")
+	ErrControlHost        = errors.New("invalid host for the control API")
+	ErrControlToken       = errors.New("missing or invalid control token")
+	ErrControlContentType = errors.New("content type must be application/json")
+)
+
+// AddRequest adds a torrent to download, or to seed when Seed is set
+type AddRequest struct {
+	// Path of a metainfo file, or a magnet link
+	Torrent string `json:"torrent"`
+	// Where to download, the default download directory if empty,
+	// or the data to seed
+	Path      string `json:"path"`
+	Seed      bool   `json:"seed,omitempty"`
+	SuperSeed bool   `json:"super_seed,omitempty"`
+	// Path is existing data, it is verified then the valid pieces are
+	// seeded and the missing ones downloaded
+	Existing bool `json:"existing,omitempty"`
+	// Directories to look for files of the torrent in, the matching
+	// ones are linked into Path instead of being downloaded
+	CrossSeedDirs []string `json:"cross_seed_dirs,omitempty"`
+}
+
+// MoveRequest moves the data of a seeded torrent to another directory
+type MoveRequest struct {
+	Path string `json:"path"`
+}
+
+// LimitsRequest changes the limits of the peer or of a torrent,
+// nil fields are left unchanged
+type LimitsRequest struct {
+	// Bytes per second, 0 for no limit
+	UploadRate   *int `json:"upload_rate,omitempty"`
+	DownloadRate *int `json:"download_rate,omitempty"`
+	// Torrents only, 0 for the global limit and negative for no limit
+	RatioLimit *float64 `json:"ratio_limit,omitempty"`
+	// In minutes
+	SeedTimeLimit *int `json:"seed_time_limit,omitempty"`
+}
+
+// PriorityRequest changes the order the pieces of a torrent are downloaded in,
+// nil fields are left unchanged
+type PriorityRequest struct {
+	Sequential *bool `json:"sequential,omitempty"`
+	// Byte offset of the reader of the data, the pieces after it are
+	// downloaded first, negative to stop streaming
+	StreamOffset *int64 `json:"stream_offset,omitempty"`
+	// Pieces downloaded first, 0 for the configured window
+	StreamWindow int `json:"stream_window,omitempty"`
+}
+
+// TorrentStatus is a torrent as reported by the control API
+type TorrentStatus struct {
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	// Fraction of the data verified, from 0 to 1
+	Progress      float64 `json:"progress"`
+	QueuePosition int     `json:"queue_position"`
+	Forced        bool    `json:"forced,omitempty"`
+	Sequential    bool    `json:"sequential,omitempty"`
+	// Bytes
+	Uploaded           int64   `json:"uploaded"`
+	Downloaded         int64   `json:"downloaded"`
+	UploadedOverhead   int64   `json:"uploaded_overhead"`
+	DownloadedOverhead int64   `json:"downloaded_overhead"`
+	Ratio              float64 `json:"ratio"`
+	// Seconds
+	SeedTime int64 `json:"seed_time"`
+}
+
+// Stats are the totals of the peer
+type Stats struct {
+	Torrents int            `json:"torrents"`
+	States   map[string]int `json:"states"`
+	// Bytes over all torrents
+	Uploaded           int64 `json:"uploaded"`
+	Downloaded         int64 `json:"downloaded"`
+	UploadedOverhead   int64 `json:"uploaded_overhead"`
+	DownloadedOverhead int64 `json:"downloaded_overhead"`
+	// Global limits in bytes per second, 0 for no limit
+	UploadRate   int `json:"upload_rate"`
+	DownloadRate int `json:"download_rate"`
+	Connections  int `json:"connections"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// ParseInfoHash parses the hex encoding of an info hash
+func ParseInfoHash(s string) (torrent.Sha1Hash, error) {
+	var h torrent.Sha1Hash
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(h) {
+		return h, ErrInvalidInfoHash
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// magnetLink is what a magnet link tells about a torrent,
+// its metainfo is fetched from the peers of the trackers
+type magnetLink struct {
+	infoHash torrent.Sha1Hash
+	// display name, may be empty
+	name     string
+	trackers []string
+}
+
+// parseMagnet returns the info hash of a magnet link, encoded in hex
+// or base32 as allowed by BEP 9, with its name and trackers
+func parseMagnet(link string) (*magnetLink, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, ErrInvalidMagnet
+	}
+	query := u.Query()
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		m := &magnetLink{name: query.Get("dn"), trackers: query["tr"]}
+		if len(encoded) == 32 {
+			b, err := base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+			if err != nil {
+				return nil, ErrInvalidMagnet
+			}
+			copy(m.infoHash[:], b)
+			return m, nil
+		}
+		if m.infoHash, err = ParseInfoHash(encoded); err != nil {
+			return nil, ErrInvalidMagnet
+		}
+		return m, nil
+	}
+	return nil, ErrInvalidMagnet
+}
+
+// progress is the fraction of the data of a torrent that is verified
+func (p *Peer) progress(mt *managedTorrent) float64 {
+	if mt.Length == 0 {
+		return 1
+	}
+	if sw := mt.getSwarm(); sw != nil {
+		return 1 - float64(bytesLeft(mt.TorrentFile, sw.data.Completed()))/float64(mt.Length)
+	}
+	mt.mu.Lock()
+	seeding := mt.seeding
+	mt.mu.Unlock()
+	if seeding {
+		return 1
+	}
+
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	cache, ok := p.cache[mt.InfoHash.String()]
+	if !ok {
+		return 0
+	}
+	return 1 - float64(bytesLeft(mt.TorrentFile, cache.Bitfield))/float64(mt.Length)
+}
+
+func (p *Peer) torrentStatus(mt *managedTorrent) TorrentStatus {
+	info := mt.info()
+	status := TorrentStatus{
+		InfoHash:           info.InfoHash.String(),
+		Name:               info.Name,
+		Path:               info.Path,
+		State:              info.State.String(),
+		Progress:           p.progress(mt),
+		QueuePosition:      p.queue.position(mt),
+		Forced:             info.Forced,
+		Sequential:         info.Sequential,
+		Uploaded:           info.Uploaded,
+		Downloaded:         info.Downloaded,
+		UploadedOverhead:   info.UploadedOverhead,
+		DownloadedOverhead: info.DownloadedOverhead,
+		Ratio:              info.Ratio,
+		SeedTime:           int64(info.SeedTime / time.Second),
+	}
+	if info.Error != nil {
+		status.Error = info.Error.Error()
+	}
+	return status
+}
+
+// Stats returns the totals of the peer
+func (p *Peer) Stats() Stats {
+	stats := Stats{States: make(map[string]int)}
+	for _, mt := range p.torrents.list() {
+		stats.Torrents++
+		stats.States[mt.State().String()]++
+		stats.Uploaded += mt.counters.uploaded.Load()
+		stats.Downloaded += mt.counters.downloaded.Load()
+		stats.UploadedOverhead += mt.counters.uploadedOverhead.Load()
+		stats.DownloadedOverhead += mt.counters.downloadedOverhead.Load()
+		if sw := mt.getSwarm(); sw != nil {
+			sw.mu.Lock()
+			stats.Connections += len(sw.conns)
+			sw.mu.Unlock()
+		}
+	}
+	p.limitersMu.Lock()
+	stats.UploadRate = p.uploadRate
+	stats.DownloadRate = p.downloadRate
+	p.limitersMu.Unlock()
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, controlError{Error: err.Error()})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTorrentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTorrentExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// torrentFromRequest finds the torrent named by the path of the request
+func (p *Peer) torrentFromRequest(w http.ResponseWriter, r *http.Request) (*managedTorrent, bool) {
+	infoHash, err := ParseInfoHash(r.PathValue("hash"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrTorrentNotFound)
+		return nil, false
+	}
+	return mt, true
+}
+
+// LoadControlToken reads the token required by the control API, see Config.ControlTokenPath
+func LoadControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// controlToken returns the token of the control API, it is generated
+// on first use in a file only readable by the user
+func controlToken(path string) (string, error) {
+	token, err := LoadControlToken(path)
+	if err == nil && token != "" {
+		return token, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, utils.WriteFileAtomic(path, []byte(token+"\n"), 0600)
+}
+
+// checkHost refuses requests for other hosts, e.g. from a web page through DNS rebinding
+func checkHost(host, addr string) bool {
+	if host == addr {
+		return true
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	_, want, err := net.SplitHostPort(addr)
+	if err != nil || port != want {
+		return false
+	}
+	ip := net.ParseIP(name)
+	return name == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// checkToken accepts the token as a bearer token, or in the query of a read
+// so that the URL of a file can be given to a video player
+func checkToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		got = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// controlHandler serves the API on addr to the clients with the token
+func (p *Peer) controlHandler(addr, token string) http.Handler {
+	mux := p.controlMux()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkHost(r.Host, addr) {
+			writeError(w, http.StatusMisdirectedRequest, ErrControlHost)
+			return
+		}
+		if !checkToken(r, token) {
+			writeError(w, http.StatusUnauthorized, ErrControlToken)
+			return
+		}
+		// a web page cannot send JSON without a preflight request
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, ErrControlContentType)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (p *Peer) controlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /torrents", func(w http.ResponseWriter, r *http.Request) {
+		torrents := p.torrents.list()
+		statuses := make([]TorrentStatus, 0, len(torrents))
+		for _, mt := range torrents {
+			statuses = append(statuses, p.torrentStatus(mt))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+
+	mux.HandleFunc("POST /torrents", func(w http.ResponseWriter, r *http.Request) {
+		var req AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if strings.HasPrefix(req.Torrent, "magnet:") {
+			m, err := parseMagnet(req.Torrent)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			// the data of a magnet link is always downloaded
+			if req.Seed || req.Existing || len(req.CrossSeedDirs) > 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("A magnet link can only be downloaded, add the metainfo file instead"))
+				return
+			}
+			if len(m.trackers) == 0 {
+				writeError(w, http.StatusBadRequest, ErrMagnetNoTracker)
+				return
+			}
+			if _, ok := p.torrents.get(m.infoHash); ok {
+				writeError(w, http.StatusConflict, ErrTorrentExists)
+				return
+			}
+			p.RegisterEvent(&EventMagnet{DownloadPath: req.Path, Link: req.Torrent})
+			writeJSON(w, http.StatusAccepted, map[string]string{"info_hash": m.infoHash.String()})
+			return
+		}
+
+		if (req.Seed || req.Existing) && req.Path == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("The path of the data is required"))
+			return
+		}
+
+		// fail early on invalid metainfo, the event opens it again
+		tf, err := torrent.Open(req.Torrent)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := p.torrents.get(tf.InfoHash); ok {
+			writeError(w, http.StatusConflict, ErrTorrentExists)
+			return
+		}
+		if len(req.CrossSeedDirs) > 0 {
+			p.RegisterEvent(&EventCrossSeed{DownloadPath: req.Path, TorrentPath: req.Torrent, Dirs: req.CrossSeedDirs})
+		} else if req.Existing {
+			p.RegisterEvent(&EventAddExisting{DataPath: req.Path, TorrentPath: req.Torrent})
+		} else if req.Seed {
+			p.RegisterEvent(&EventUpload{FilePath: req.Path, TorrentPath: req.Torrent, SuperSeed: req.SuperSeed})
+		} else {
+			p.RegisterEvent(&EventDownload{DownloadPath: req.Path, TorrentPath: req.Torrent})
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"info_hash": tf.InfoHash.String()})
+	})
+
+	mux.HandleFunc("GET /torrents/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		if mt, ok := p.torrentFromRequest(w, r); ok {
+			writeJSON(w, http.StatusOK, p.torrentStatus(mt))
+		}
+	})
+
+	mux.HandleFunc("GET /torrents/{hash}/files", func(w http.ResponseWriter, r *http.Request) {
+		if mt, ok := p.torrentFromRequest(w, r); ok {
+			writeJSON(w, http.StatusOK, p.fileStatuses(mt))
+		}
+	})
+
+	// the content of a file, readable while it is downloaded
+	mux.HandleFunc("GET /torrents/{hash}/files/{index}", func(w http.ResponseWriter, r *http.Request) {
+		if mt, ok := p.torrentFromRequest(w, r); ok {
+			p.serveFile(w, r, mt)
+		}
+	})
+
+	mux.HandleFunc("POST /torrents/{hash}/pause", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := p.Pause(mt.InfoHash); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.torrentStatus(mt))
+	})
+
+	// resuming runs the torrent, it is done by the event loop
+	mux.HandleFunc("POST /torrents/{hash}/resume", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if state := mt.State(); state != StatePaused && state != StateError {
+			writeError(w, http.StatusConflict, fmt.Errorf("Cannot resume a torrent that is %s", state))
+			return
+		}
+		p.RegisterEvent(&EventResume{InfoHash: mt.InfoHash})
+		writeJSON(w, http.StatusAccepted, p.torrentStatus(mt))
+	})
+
+	mux.HandleFunc("POST /torrents/{hash}/force", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		p.RegisterEvent(&EventForceStart{InfoHash: mt.InfoHash})
+		writeJSON(w, http.StatusAccepted, p.torrentStatus(mt))
+	})
+
+	// moving copies the data across filesystems, it may take a while
+	mux.HandleFunc("POST /torrents/{hash}/move", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		var req MoveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Path == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("The destination directory is required"))
+			return
+		}
+		if err := p.MoveStorage(mt.InfoHash, req.Path); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.torrentStatus(mt))
+	})
+
+	mux.HandleFunc("DELETE /torrents/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		deleteData := r.URL.Query().Get("delete_data") == "true"
+		if err := p.Remove(mt.InfoHash, deleteData); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /torrents/{hash}/limits", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		var req LimitsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		tl := p.getTorrentLimiters(mt.InfoHash)
+		upload, download := tl.upload.Limit(), tl.download.Limit()
+		if req.UploadRate != nil {
+			upload = *req.UploadRate
+		}
+		if req.DownloadRate != nil {
+			download = *req.DownloadRate
+		}
+		p.SetTorrentRateLimits(mt.InfoHash, upload, download)
+
+		if req.RatioLimit != nil || req.SeedTimeLimit != nil {
+			mt.mu.Lock()
+			ratio, seedTime := mt.ratioLimit, mt.seedTimeLimit
+			mt.mu.Unlock()
+			if req.RatioLimit != nil {
+				ratio = *req.RatioLimit
+			}
+			if req.SeedTimeLimit != nil {
+				seedTime = time.Duration(*req.SeedTimeLimit) * time.Minute
+			}
+			if err := p.SetSeedLimits(mt.InfoHash, ratio, seedTime); err != nil {
+				writeError(w, errorStatus(err), err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, p.torrentStatus(mt))
+	})
+
+	mux.HandleFunc("PUT /torrents/{hash}/priority", func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := p.torrentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		var req PriorityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Sequential != nil {
+			if err := p.SetSequential(mt.InfoHash, *req.Sequential); err != nil {
+				writeError(w, errorStatus(err), err)
+				return
+			}
+		}
+		if req.StreamOffset != nil {
+			if err := p.SetStreaming(mt.InfoHash, *req.StreamOffset, req.StreamWindow); err != nil {
+				writeError(w, errorStatus(err), err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, p.torrentStatus(mt))
+	})
+
+	mux.HandleFunc("PUT /limits", func(w http.ResponseWriter, r *http.Request) {
+		var req LimitsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		stats := p.Stats()
+		upload, download := stats.UploadRate, stats.DownloadRate
+		if req.UploadRate != nil {
+			upload = *req.UploadRate
+		}
+		if req.DownloadRate != nil {
+			download = *req.DownloadRate
+		}
+		p.SetRateLimits(upload, download)
+		writeJSON(w, http.StatusOK, p.Stats())
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.Stats())
+	})
+
+	return mux
+}
+
+// checkLoopback refuses addresses reachable from other hosts
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return ErrControlNotLoopback
+	}
+	return nil
+}
+
+// serveControl serves the control API until the context is done
+func (p *Peer) serveControl(ctx context.Context, addr string) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	token, err := controlToken(p.config.ControlTokenPath)
+	if err != nil {
+		return fmt.Errorf("Failed to create the control token: %w", err)
+	}
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           p.controlHandler(addr, token),
+		ReadHeaderTimeout: controlReadHeaderTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package peer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+const testControlToken = "secret"
+
+// newControlServer serves the control API of the peer to a client with its token
+func newControlServer(t *testing.T, p *Peer) *ControlClient {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	addr := srv.Listener.Addr().String()
+	srv.Config.Handler = p.controlHandler(addr, testControlToken)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return NewControlClient(addr, testControlToken)
+}
+
+func TestControlAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	torrentPath := filepath.Join(dir, "file.torrent")
+	if err := tf.Save(torrentPath); err != nil {
+		t.Fatal(err)
+	}
+	// the info hash of the saved metainfo
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	p.events = make(chan Event, 1)
+	c := newControlServer(t, p)
+
+	seeded := make(chan error, 1)
+	go func() { seeded <- p.seedTorrent(ctx, tf, path, false) }()
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	hash := tf.InfoHash.String()
+
+	statuses, err := c.List()
+	if err != nil {
+		t.Fatalf("Failed to list: %s", err)
+	}
+	if len(statuses) != 1 || statuses[0].InfoHash != hash || statuses[0].State != "seeding" {
+		t.Fatalf("Expected the seeding torrent, got %+v", statuses)
+	}
+	if statuses[0].Progress != 1 {
+		t.Errorf("Expected progress 1, got %f", statuses[0].Progress)
+	}
+
+	ratio, upload := 2.0, 100
+	if err := c.SetLimits(hash, LimitsRequest{RatioLimit: &ratio, UploadRate: &upload}); err != nil {
+		t.Fatalf("Failed to set limits: %s", err)
+	}
+	if limit := p.getTorrentLimiters(tf.InfoHash).upload.Limit(); limit != upload {
+		t.Errorf("Expected upload limit %d, got %d", upload, limit)
+	}
+	if err := c.SetLimits("", LimitsRequest{DownloadRate: &upload}); err != nil {
+		t.Fatalf("Failed to set global limits: %s", err)
+	}
+
+	if err := c.Pause(hash); err != nil {
+		t.Fatalf("Failed to pause: %s", err)
+	}
+	if err := <-seeded; err != nil {
+		t.Errorf("Expected seeding to stop cleanly, got %s", err)
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %s", err)
+	}
+	if stats.Torrents != 1 || stats.States["paused"] != 1 || stats.DownloadRate != upload {
+		t.Errorf("Expected one paused torrent and the new download limit, got %+v", stats)
+	}
+
+	if err := c.Resume(hash); err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if e, ok := (<-p.events).(*EventResume); !ok || e.InfoHash != tf.InfoHash {
+		t.Errorf("Expected a resume event, got %+v", e)
+	}
+
+	// the torrent is already added
+	if _, err := c.Add(AddRequest{Torrent: torrentPath, Path: dir}); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if _, err := c.Add(AddRequest{Torrent: "magnet:?xt=urn:btih:" + hash + "&tr=" + tf.Announce}); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("Expected a conflict for the magnet link, got %v", err)
+	}
+	if _, err := c.Add(AddRequest{Torrent: "magnet:?xt=urn:btih:" + hash}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected a magnet link without tracker to be rejected, got %v", err)
+	}
+
+	if err := c.Remove(hash, false); err != nil {
+		t.Fatalf("Failed to remove: %s", err)
+	}
+	if err := c.Pause(hash); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if err := c.Pause("nothex"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the data to be kept, got %s", err)
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	want := torrent.Sha1Hash{0x01, 0x23, 0x45}
+	hex := "magnet:?xt=urn:btih:" + want.String() + "&dn=file"
+	base32 := "magnet:?xt=urn:btih:AERUKAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	for _, link := range []string{hex, base32} {
+		m, err := parseMagnet(link)
+		if err != nil || m.infoHash != want {
+			t.Errorf("Expected %s from %s, got %+v (%v)", want, link, m, err)
+		}
+	}
+	m, err := parseMagnet(hex + "&tr=http%3A%2F%2Fa%2Fannounce&tr=http://b/announce")
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %s", err)
+	}
+	if m.name != "file" || !reflect.DeepEqual(m.trackers, []string{"http://a/announce", "http://b/announce"}) {
+		t.Errorf("Expected the name and both trackers, got %+v", m)
+	}
+	if _, err := parseMagnet("http://example.com"); err != ErrInvalidMagnet {
+		t.Errorf("Expected ErrInvalidMagnet, got %v", err)
+	}
+}
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:6880", "[::1]:6880", "localhost:6880"} {
+		if err := checkLoopback(addr); err != nil {
+			t.Errorf("Expected %s to be allowed, got %s", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:6880", ":6880", "192.168.1.2:6880"} {
+		if err := checkLoopback(addr); err == nil {
+			t.Errorf("Expected %s to be refused", addr)
+		}
+	}
+}
+
+func TestControlAccess(t *testing.T) {
+	p := newTestPeer(t, filepath.Join(t.TempDir(), "cache.json"))
+	c := newControlServer(t, p)
+
+	request := func(method, url, host, token, contentType string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	url := c.baseURL + "/limits"
+	if status := request(http.MethodPut, url, "", testControlToken, "application/json"); status != http.StatusOK {
+		t.Errorf("Expected 200, got %d", status)
+	}
+	if status := request(http.MethodPut, url, "", "", "application/json"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", status)
+	}
+	if status := request(http.MethodPut, url, "", "wrong", "application/json"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", status)
+	}
+	// a cross-site form or text request
+	if status := request(http.MethodPut, url, "", testControlToken, "text/plain"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for text, got %d", status)
+	}
+	// DNS rebinding
+	if status := request(http.MethodGet, c.baseURL+"/stats", "evil.example:80", testControlToken, ""); status != http.StatusMisdirectedRequest {
+		t.Errorf("Expected 421 for another host, got %d", status)
+	}
+	// reads may pass the token in the query
+	if status := request(http.MethodGet, c.baseURL+"/stats?token="+testControlToken, "", "", ""); status != http.StatusOK {
+		t.Errorf("Expected 200 with the token in the query, got %d", status)
+	}
+}
+
+func TestControlToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.token")
+	token, err := controlToken(path)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("Expected a new token, got %q (%v)", token, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the token to be only readable by the user, got %v (%v)", info.Mode(), err)
+	}
+	if again, err := controlToken(path); err != nil || again != token {
+		t.Errorf("Expected the same token, got %q (%v)", again, err)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1:6880", "localhost:6880", "[::1]:6880"} {
+		if !checkHost(host, DefaultControlAddr) {
+			t.Errorf("Expected %s to be allowed", host)
+		}
+	}
+	for _, host := range []string{"evil.example:6880", "127.0.0.1:80", "127.0.0.1", "192.168.1.2:6880"} {
+		if checkHost(host, DefaultControlAddr) {
+			t.Errorf("Expected %s to be refused", host)
+		}
+	}
+}
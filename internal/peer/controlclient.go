@@ -0,0 +1,137 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ControlClient talks to the control API of a running peer
+type ControlClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewControlClient sends the token with every request, see LoadControlToken
+func NewControlClient(addr, token string) *ControlClient {
+	return &ControlClient{
+		baseURL: "http://" + addr,
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends the request and decodes the response into out if not nil
+func (c *ControlClient) do(method, path string, in, out any) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var cerr controlError
+		if err := json.NewDecoder(resp.Body).Decode(&cerr); err != nil || cerr.Error == "" {
+			return fmt.Errorf("Control API returned %s", resp.Status)
+		}
+		return fmt.Errorf("Control API returned %s: %s", resp.Status, cerr.Error)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Add adds a torrent and returns its info hash, it starts in the background
+func (c *ControlClient) Add(req AddRequest) (string, error) {
+	var resp struct {
+		InfoHash string `json:"info_hash"`
+	}
+	err := c.do(http.MethodPost, "/torrents", req, &resp)
+	return resp.InfoHash, err
+}
+
+func (c *ControlClient) List() ([]TorrentStatus, error) {
+	var statuses []TorrentStatus
+	err := c.do(http.MethodGet, "/torrents", nil, &statuses)
+	return statuses, err
+}
+
+func (c *ControlClient) Get(infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.do(http.MethodGet, "/torrents/"+url.PathEscape(infoHash), nil, &status)
+	return status, err
+}
+
+func (c *ControlClient) Pause(infoHash string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/pause", nil, nil)
+}
+
+func (c *ControlClient) Resume(infoHash string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/resume", nil, nil)
+}
+
+func (c *ControlClient) ForceStart(infoHash string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/force", nil, nil)
+}
+
+func (c *ControlClient) MoveStorage(infoHash, dir string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/move", MoveRequest{Path: dir}, nil)
+}
+
+func (c *ControlClient) Remove(infoHash string, deleteData bool) error {
+	path := "/torrents/" + url.PathEscape(infoHash)
+	if deleteData {
+		path += "?delete_data=true"
+	}
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+// SetLimits changes the global limits, or the limits of a torrent if the info hash is not empty
+func (c *ControlClient) SetLimits(infoHash string, req LimitsRequest) error {
+	path := "/limits"
+	if infoHash != "" {
+		path = "/torrents/" + url.PathEscape(infoHash) + "/limits"
+	}
+	return c.do(http.MethodPut, path, req, nil)
+}
+
+func (c *ControlClient) SetPriority(infoHash string, req PriorityRequest) error {
+	return c.do(http.MethodPut, "/torrents/"+url.PathEscape(infoHash)+"/priority", req, nil)
+}
+
+func (c *ControlClient) Files(infoHash string) ([]FileStatus, error) {
+	var files []FileStatus
+	err := c.do(http.MethodGet, "/torrents/"+url.PathEscape(infoHash)+"/files", nil, &files)
+	return files, err
+}
+
+// FileURL is where the file is streamed from, e.g. by a video player, it contains the token
+func (c *ControlClient) FileURL(infoHash string, index int) string {
+	return fmt.Sprintf("%s/torrents/%s/files/%d?token=%s", c.baseURL, url.PathEscape(infoHash), index, url.QueryEscape(c.token))
+}
+
+func (c *ControlClient) Stats() (Stats, error) {
+	var stats Stats
+	err := c.do(http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
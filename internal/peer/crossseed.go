@@ -0,0 +1,254 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/common/utils"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+// crossSeedMatch is a local file with the content of a file of a torrent
+type crossSeedMatch struct {
+	// index of the file in the layout of the torrent
+	file int
+	path string
+	// some pieces of the file span other files, they are not verified yet
+	shared bool
+}
+
+// findCrossSeed looks in the directories for files with the size of a file of the torrent,
+// a candidate is kept when the pieces lying entirely within it match their hash.
+// A small file may have no such piece, its candidates are then checked with
+// the pieces it shares with the files already matched, see matchShared
+func findCrossSeed(tf *torrent.TorrentFile, dirs []string) ([]crossSeedMatch, error) {
+	layout := storage.Layout(tf)
+	offsets := make([]int64, len(layout))
+	bySize := make(map[int64][]int)
+	var offset int64
+	for i, f := range layout {
+		offsets[i] = offset
+		offset += int64(f.Length)
+		if f.Length > 0 {
+			bySize[int64(f.Length)] = append(bySize[int64(f.Length)], i)
+		}
+	}
+
+	matched := make(map[int]string)
+	// candidates of the files without a whole piece, in the order found
+	unverified := make(map[int][]string)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			for _, i := range bySize[info.Size()] {
+				if _, ok := matched[i]; ok {
+					continue
+				}
+				ok, checked, err := piecesMatch(tf, offsets[i], int64(layout[i].Length), path)
+				if err != nil {
+					logger.Error("Failed to check cross-seed candidate", "file", path, "error", err)
+					break
+				}
+				if ok && checked == 0 {
+					unverified[i] = append(unverified[i], path)
+					continue
+				}
+				if ok {
+					matched[i] = path
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	matchShared(tf, layout, offsets, matched, unverified)
+
+	matches := make([]crossSeedMatch, 0, len(matched))
+	for i, path := range matched {
+		begin, end := offsets[i], offsets[i]+int64(layout[i].Length)
+		firstBegin, _ := tf.PieceBounds(int(begin / int64(tf.PieceLength)))
+		_, lastEnd := tf.PieceBounds(int((end - 1) / int64(tf.PieceLength)))
+		shared := int64(firstBegin) < begin || int64(lastEnd) > end
+		matches = append(matches, crossSeedMatch{file: i, path: path, shared: shared})
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].file < matches[b].file })
+	return matches, nil
+}
+
+// piecesMatch checks the pieces of the torrent lying entirely within the file at offset
+// and returns how many there are, a small file may have none
+func piecesMatch(tf *torrent.TorrentFile, offset, length int64, path string) (bool, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+
+	first := int((offset + int64(tf.PieceLength) - 1) / int64(tf.PieceLength))
+	buf := make([]byte, tf.PieceLength)
+	checked := 0
+	for i := first; i < tf.NumPieces(); i++ {
+		begin, end := tf.PieceBounds(i)
+		if int64(end) > offset+length {
+			break
+		}
+		piece := buf[:end-begin]
+		if _, err := f.ReadAt(piece, int64(begin)-offset); err != nil {
+			return false, checked, err
+		}
+		if sha1.Sum(piece) != tf.PieceHashes[i] {
+			return false, checked, nil
+		}
+		checked++
+	}
+	return true, checked, nil
+}
+
+// matchShared picks the candidates of the files without a whole piece whose pieces match
+// along with the files already matched, a file is kept once at least one of its pieces
+// is checked, those spanning files not found stay unmatched and are downloaded
+func matchShared(tf *torrent.TorrentFile, layout []torrent.File, offsets []int64, matched map[int]string, unverified map[int][]string) {
+	for progress := true; progress; {
+		progress = false
+		for i, paths := range unverified {
+			for _, path := range paths {
+				ok, err := sharedPiecesMatch(tf, layout, offsets, matched, i, path)
+				if err != nil {
+					logger.Error("Failed to check cross-seed candidate", "file", path, "error", err)
+					continue
+				}
+				if ok {
+					matched[i] = path
+					delete(unverified, i)
+					progress = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// sharedPiecesMatch checks the pieces of file i whose other files are all matched,
+// with path as the content of file i
+func sharedPiecesMatch(tf *torrent.TorrentFile, layout []torrent.File, offsets []int64, matched map[int]string, i int, path string) (bool, error) {
+	begin, end := offsets[i], offsets[i]+int64(layout[i].Length)
+	checked := 0
+	for index := int(begin / int64(tf.PieceLength)); index <= int((end-1)/int64(tf.PieceLength)); index++ {
+		pieceBegin, pieceEnd := tf.PieceBounds(index)
+		piece := make([]byte, pieceEnd-pieceBegin)
+		complete := true
+		for j := range layout {
+			from, to := max(offsets[j], int64(pieceBegin)), min(offsets[j]+int64(layout[j].Length), int64(pieceEnd))
+			if from >= to {
+				continue
+			}
+			src := path
+			if j != i {
+				var ok bool
+				if src, ok = matched[j]; !ok {
+					complete = false
+					break
+				}
+			}
+			if err := readRange(src, piece[from-int64(pieceBegin):to-int64(pieceBegin)], from-offsets[j]); err != nil {
+				return false, err
+			}
+		}
+		if !complete {
+			continue
+		}
+		if sha1.Sum(piece) != tf.PieceHashes[index] {
+			return false, nil
+		}
+		checked++
+	}
+	return checked > 0, nil
+}
+
+func readRange(path string, buf []byte, offset int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, offset)
+	return err
+}
+
+// linkFile makes the file available at dst, without copying it if possible
+func linkFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return os.ErrExist
+	}
+	// hard links are not possible across filesystems
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(abs, dst)
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return os.ErrExist
+	}
+	return utils.CopyFile(src, dst, 0644)
+}
+
+// crossSeed adds a torrent reusing the matching files found in the directories as its data,
+// they are verified then seeded and the missing files are downloaded to the directory
+func (p *Peer) crossSeed(ctx context.Context, tf *torrent.TorrentFile, dirs []string, dir string) error {
+	matches, err := findCrossSeed(tf, dirs)
+	if err != nil {
+		return err
+	}
+	logger.Info("Found cross-seed files", "infohash", tf.InfoHash.String(), "matches", len(matches), "files", len(storage.Layout(tf)))
+
+	// the matches are linked into a data path of the torrent, so that
+	// removing or moving it never touches the original files
+	dataPath := filepath.Join(p.downloadDir(dir), tf.Name)
+	paths, err := storage.FilePaths(tf, dataPath)
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		var err error
+		// a piece spanning another file may be downloaded, which
+		// must not write through a link into the original
+		if m.shared {
+			err = copyFile(m.path, paths[m.file])
+		} else {
+			err = linkFile(m.path, paths[m.file])
+		}
+		if err != nil {
+			logger.Error("Failed to reuse cross-seed file", "file", m.path, "error", err)
+		}
+	}
+	return p.addExisting(ctx, tf, dataPath)
+}
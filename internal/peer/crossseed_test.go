@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestCrossSeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef")
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	tf.InfoHash = torrent.Sha1Hash{0xc5}
+	tf.Name = "album"
+	// the last piece spans b.bin and c.bin
+	tf.Files = []torrent.File{
+		{Length: 8, Path: []string{"a.bin"}},
+		{Length: 5, Path: []string{"sub", "b.bin"}},
+		{Length: 3, Path: []string{"c.bin"}},
+	}
+
+	write := func(path string, content []byte) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	write(filepath.Join(first, "copy", "a.bin"), data[:8])
+	// same size as a.bin, but a different content
+	write(filepath.Join(first, "decoy.bin"), []byte("xxxxxxxx"))
+	// c.bin has no whole piece, the candidate found first does not match
+	// the piece it shares with b.bin
+	write(filepath.Join(first, "c-decoy.bin"), []byte("xxx"))
+	write(filepath.Join(second, "b.bin"), data[8:13])
+	write(filepath.Join(second, "c.bin"), data[13:])
+
+	matches, err := findCrossSeed(tf, []string{first, second})
+	if err != nil {
+		t.Fatalf("Failed to find files: %s", err)
+	}
+	want := []crossSeedMatch{
+		{file: 0, path: filepath.Join(first, "copy", "a.bin")},
+		{file: 1, path: filepath.Join(second, "b.bin"), shared: true},
+		{file: 2, path: filepath.Join(second, "c.bin"), shared: true},
+	}
+	if len(matches) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, matches)
+	}
+	for i := range want {
+		if matches[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want[i], matches[i])
+		}
+	}
+
+	// without b.bin the piece of c.bin cannot be checked
+	third := filepath.Join(dir, "third")
+	write(filepath.Join(third, "c.bin"), data[13:])
+	matches, err = findCrossSeed(tf, []string{first, third})
+	if err != nil {
+		t.Fatalf("Failed to find files: %s", err)
+	}
+	if len(matches) != 1 || matches[0] != want[0] {
+		t.Errorf("Expected only %v, got %v", want[0], matches)
+	}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	downloads := filepath.Join(dir, "downloads")
+	go p.crossSeed(ctx, tf, []string{first, second}, downloads)
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	got, err := os.ReadFile(filepath.Join(downloads, "album", "sub", "b.bin"))
+	if err != nil || string(got) != string(data[8:13]) {
+		t.Errorf("Expected the file to be reused, got %q (%v)", got, err)
+	}
+	// only the files whose pieces were all verified are linked
+	sameFile := func(a, b string) bool {
+		t.Helper()
+		ia, err := os.Stat(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ib, err := os.Stat(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(ia, ib)
+	}
+	if !sameFile(want[0].path, filepath.Join(downloads, "album", "a.bin")) {
+		t.Errorf("Expected a.bin to be linked")
+	}
+	if sameFile(want[1].path, filepath.Join(downloads, "album", "sub", "b.bin")) {
+		t.Errorf("Expected b.bin to be copied")
+	}
+	mt, _ := p.torrents.get(tf.InfoHash)
+	if downloaded := mt.counters.downloaded.Load(); downloaded != 0 {
+		t.Errorf("Expected nothing downloaded, got %d bytes", downloaded)
+	}
+
+	// a single file is linked too, the original is never removed with the torrent
+	single := testTorrent(data[:8], 4)
+	single.Announce = tracker.URL
+	single.InfoHash = torrent.Sha1Hash{0xc6}
+	single.Name = "single.bin"
+	go p.crossSeed(ctx, single, []string{first}, downloads)
+	waitForState(t, p, single.InfoHash, StateSeeding)
+	mt, _ = p.torrents.get(single.InfoHash)
+	if path, want := mt.info().Path, filepath.Join(downloads, "single.bin"); path != want {
+		t.Errorf("Expected seeding from %s, got %s", want, path)
+	}
+	if err := p.Remove(single.InfoHash, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(want[0].path); err != nil {
+		t.Errorf("Expected the original file to be kept, got %s", err)
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chezzijr/p2p/internal/common/api"
 	"github.com/chezzijr/p2p/internal/common/connection"
 	"github.com/chezzijr/p2p/internal/common/peers"
 	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
 )
 
 const (
@@ -29,17 +33,21 @@ var (
 type DownloadSession struct {
 	*torrent.TorrentFile
 	peerInfo *Peer
-	fd       *os.File
+	data     storage.Torrent
+	dataPath string
 	peers    []peers.Peer
 	bitfield connection.BitField
 	done     bool
+	// pieces written but not flushed yet, see commitPieces
+	mu        sync.Mutex
+	unflushed []int
+	// hands out the missing pieces to the connections
+	picker *piecePicker
+	// the connections of the torrent
+	swarm *swarm
 }
 
 func (p *Peer) NewDownloadSession(t *torrent.TorrentFile, filepath string) (*DownloadSession, error) {
-	if _, ok := p.downloadingPeers[t.InfoHash.String()]; ok {
-		return nil, fmt.Errorf("Already downloading")
-	}
-
 	// get initial peers
 	initialPeers, err := t.RequestPeers(p.PeerID, p.Port)
 	if err != nil {
@@ -50,38 +58,57 @@ func (p *Peer) NewDownloadSession(t *torrent.TorrentFile, filepath string) (*Dow
 		return nil, fmt.Errorf("No peers available")
 	}
 
-	if cache, ok := p.cache[t.InfoHash.String()]; ok {
+	p.cacheMu.Lock()
+	cache, ok := p.cache[t.InfoHash.String()]
+	p.cacheMu.Unlock()
+	if ok {
 		// resume download
-		filename := cache.Filepath
-		fd, err := os.OpenFile(filename, os.O_RDWR, os.ModePerm)
+		p.cacheMu.Lock()
+		bitfield := make(connection.BitField, len(cache.Bitfield))
+		copy(bitfield, cache.Bitfield)
+		p.cacheMu.Unlock()
+		if _, err := os.Stat(cache.Filepath); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			// nothing was written yet, or the data was deleted
+			bitfield = connection.NewBitField(t.NumPieces())
+			p.cacheMu.Lock()
+			cache.Bitfield = connection.NewBitField(t.NumPieces())
+			p.cacheMu.Unlock()
+		}
+		data, err := p.storage.Open(t, cache.Filepath)
 		if err != nil {
 			return nil, err
 		}
+		for i := 0; i < t.NumPieces(); i++ {
+			if bitfield.HasPiece(i) {
+				data.MarkComplete(i)
+			}
+		}
 
 		session := &DownloadSession{
 			TorrentFile: t,
 			peerInfo:    p,
-			fd:          fd,
-			bitfield:    cache.Bitfield,
+			data:        data,
+			dataPath:    cache.Filepath,
+			bitfield:    bitfield,
 			peers:       initialPeers,
 			done:        false,
 		}
-		p.downloadingPeers[t.InfoHash.String()] = session
+		session.picker = newPiecePicker(session.missingPieces())
 		return session, nil
 	} else {
 		cache := &CachedFile{
-			Filepath: path.Join(filepath, t.Name+".tmp"),
+			Filepath: p.incompletePath(t, filepath),
 			InfoHash: t.InfoHash.String(),
 			Bitfield: connection.NewBitField(t.NumPieces()),
 		}
+		p.cacheMu.Lock()
 		p.cache[t.InfoHash.String()] = cache
+		p.cacheMu.Unlock()
 		// create file
-		filename := cache.Filepath
-		err := os.MkdirAll(filepath, os.ModePerm)
-		if err != nil {
-			return nil, err
-		}
-		fd, err := os.Create(filename)
+		data, err := p.storage.Open(t, cache.Filepath)
 		if err != nil {
 			return nil, err
 		}
@@ -92,16 +119,73 @@ func (p *Peer) NewDownloadSession(t *torrent.TorrentFile, filepath string) (*Dow
 		session := &DownloadSession{
 			TorrentFile: t,
 			peerInfo:    p,
-			fd:          fd,
+			data:        data,
+			dataPath:    cache.Filepath,
 			bitfield:    bitfield,
 			peers:       initialPeers,
 			done:        false,
 		}
-		p.downloadingPeers[t.InfoHash.String()] = session
+		session.picker = newPiecePicker(session.missingPieces())
 		return session, nil
 	}
 }
 
+// SetDataDirs overrides the configured incomplete and completed directories
+// when not empty, it must be called before Run
+func (p *Peer) SetDataDirs(incomplete, completed string) {
+	if incomplete != "" {
+		p.config.IncompleteDir = incomplete
+	}
+	if completed != "" {
+		p.config.CompletedDir = completed
+	}
+}
+
+// downloadDir is the directory a torrent is downloaded to, the default one if empty
+func (p *Peer) downloadDir(dir string) string {
+	if dir == "" {
+		return p.config.DownloadDir
+	}
+	return dir
+}
+
+// incompletePath is where the data is written while downloading
+func (p *Peer) incompletePath(t *torrent.TorrentFile, dir string) string {
+	if p.config.IncompleteDir != "" {
+		dir = p.config.IncompleteDir
+	}
+	return path.Join(dir, t.Name+".tmp")
+}
+
+// isIncompleteData tells whether the data at dataPath was created by the peer to download
+// the torrent, rather than given by the user, e.g. added from existing data or cross-seeded,
+// only such data is moved once downloaded
+func (p *Peer) isIncompleteData(t *torrent.TorrentFile, dir, dataPath string) bool {
+	p.cacheMu.Lock()
+	cache, ok := p.cache[t.InfoHash.String()]
+	existing := ok && cache.Existing
+	p.cacheMu.Unlock()
+	if existing {
+		return false
+	}
+	if filepath.Clean(dataPath) == filepath.Clean(p.incompletePath(t, dir)) {
+		return true
+	}
+	if p.config.IncompleteDir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(p.config.IncompleteDir, dataPath)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// completedPath is where the data is moved once downloaded
+func (p *Peer) completedPath(t *torrent.TorrentFile, dir string) string {
+	if p.config.CompletedDir != "" {
+		dir = p.config.CompletedDir
+	}
+	return path.Join(dir, t.Name)
+}
+
 type pieceInfo struct {
 	index  int
 	hash   [20]byte
@@ -114,44 +198,12 @@ type pieceResult struct {
 }
 
 type pieceDownloadSession struct {
-	index          int
-	assignedClient *DownloadClient
-	buf            []byte
-	downloaded     int
-	requested      int
-	backlog        int
-}
-
-func (s *pieceDownloadSession) readMessage() error {
-	msg, err := s.assignedClient.Read() // this call blocks
-	if err != nil {
-		return err
-	}
-
-	if msg == nil { // keep-alive
-		return nil
-	}
-
-	switch msg.ID {
-	case connection.MsgUnchoke:
-		s.assignedClient.Choked = false
-	case connection.MsgChoke:
-		s.assignedClient.Choked = true
-	case connection.MsgHave:
-		index, err := connection.ParseHaveMsg(msg)
-		if err != nil {
-			return err
-		}
-		s.assignedClient.Bitfield.SetPiece(index)
-	case connection.MsgPiece:
-		n, err := connection.ParsePieceMsg(s.index, s.buf, msg)
-		if err != nil {
-			return err
-		}
-		s.downloaded += n
-		s.backlog--
-	}
-	return nil
+	index      int
+	conn       *PeerConn
+	buf        []byte
+	downloaded int
+	requested  int
+	backlog    int
 }
 
 func checkIntegrity(buf []byte, piece *pieceInfo) error {
@@ -162,21 +214,30 @@ func checkIntegrity(buf []byte, piece *pieceInfo) error {
 	return nil
 }
 
-func attemptDownloadPiece(c *DownloadClient, pi *pieceInfo) ([]byte, error) {
+func attemptDownloadPiece(ctx context.Context, pc *PeerConn, pi *pieceInfo) ([]byte, error) {
 	session := pieceDownloadSession{
-		index:          pi.index,
-		assignedClient: c,
-		buf:            make([]byte, pi.length),
+		index: pi.index,
+		conn:  pc,
+		buf:   make([]byte, pi.length),
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
+	// A deadline helps get unresponsive peers unstuck.
 	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+	deadline := time.NewTimer(30 * time.Second)
+	defer deadline.Stop()
 
+	_, chokes := pc.PeerChoking()
 	for session.downloaded < pi.length {
+		choked, n := pc.PeerChoking()
+		// requests pending when choked are discarded by the remote peer
+		if n != chokes {
+			chokes = n
+			session.requested = session.downloaded
+			session.backlog = 0
+		}
+
 		// If unchoked, send requests until we have enough unfulfilled requests
-		if !session.assignedClient.Choked {
+		if !choked {
 			for session.backlog < MaxBacklog && session.requested < pi.length {
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
@@ -184,68 +245,81 @@ func attemptDownloadPiece(c *DownloadClient, pi *pieceInfo) ([]byte, error) {
 					blockSize = pi.length - session.requested
 				}
 
-				err := c.SendRequest(uint32(pi.index), uint32(session.requested), uint32(blockSize))
-				if err != nil {
-					return nil, err
-				}
-
+				pc.sendRequest(pi.index, session.requested, blockSize)
 				session.backlog++
 				session.requested += blockSize
 			}
 		}
 
-		err := session.readMessage()
-		if err != nil {
-			return nil, err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pc.closed:
+			return nil, ErrConnClosed
+		case <-deadline.C:
+			return nil, os.ErrDeadlineExceeded
+		case <-pc.wake:
+		case msg := <-pc.blocks:
+			n, err := connection.ParsePieceMsg(session.index, session.buf, msg)
+			if err != nil {
+				// a block of a piece we gave up on
+				continue
+			}
+			session.downloaded += n
+			session.backlog--
 		}
 	}
 
 	return session.buf, nil
 }
 
-func (ds *DownloadSession) downloadFromPeer(ctx context.Context, peer peers.Peer, pQ chan *pieceInfo, rQ chan *pieceResult) {
-	c, err := NewClient(ctx, peer, ds.peerInfo.PeerID, ds.InfoHash)
-	if err != nil {
-		logger.Error("Failed to create downloading client", "error", err)
-		return
-	}
-
-	defer func() {
-		c.SendNotInterested()
-		c.Close()
-	}()
-	c.SendInterested()
-
-    for {
-        select {
-        case <-ctx.Done():
-            return
-        case pi := <-pQ:
-		if !c.Bitfield.HasPiece(pi.index) {
-			pQ <- pi
+// downloadFromConn downloads pieces over a connection until the download
+// is over, for connections we opened as well as the ones we accepted
+func (ds *DownloadSession) downloadFromConn(ctx context.Context, pc *PeerConn, rQ chan *pieceResult) {
+	pc.SetInterested(true)
+	defer pc.SetInterested(false)
+
+	for {
+		changed := ds.picker.changes()
+		pi := ds.picker.pick(pc.HasPiece)
+		if pi == nil {
+			// wait for the remote peer to get new pieces, or for pieces to be put back
+			select {
+			case <-ctx.Done():
+				return
+			case <-pc.closed:
+				return
+			case <-pc.wake:
+			case <-changed:
+			case <-time.After(time.Second):
+			}
 			continue
 		}
 
 		// download piece
-		buf, err := attemptDownloadPiece(c, pi)
+		buf, err := attemptDownloadPiece(ctx, pc, pi)
 		if err != nil {
-			pQ <- pi
-			logger.Error("Failed to download piece", "error", err)
+			ds.picker.putBack(pi)
+			if ctx.Err() == nil {
+				logger.Error("Failed to download piece", "error", err)
+				pc.Close()
+			}
 			return
 		}
 
 		if err := checkIntegrity(buf, pi); err != nil {
-			pQ <- pi
+			ds.picker.putBack(pi)
 			logger.Error("Integrity check failed", "error", err)
+			pc.Close()
 			return
 		}
 
-		c.SendHave(pi.index)
-		rQ <- &pieceResult{index: pi.index, buf: buf}
-        }
-    }
-
-
+		select {
+		case <-ctx.Done():
+			return
+		case rQ <- &pieceResult{index: pi.index, buf: buf}:
+		}
+	}
 }
 
 func (ds *DownloadSession) getPieceBoundAt(index int) (int, int) {
@@ -257,16 +331,9 @@ func (ds *DownloadSession) getPieceBoundAt(index int) (int, int) {
 	return begin, end
 }
 
-func (ds *DownloadSession) Download(ctx context.Context, filepath string) error {
-	numDownloadedPieces := ds.bitfield.NumPieces()
-	ds.peerInfo.updateToTracker(ds.TorrentFile, api.Started, 0, numDownloadedPieces*ds.PieceLength)
-
-	piecesQueue := make(chan *pieceInfo, ds.NumPieces())
-	// defer close(piecesQueue)
-
-	resultsQueue := make(chan *pieceResult, ds.NumPieces())
-	// defer close(resultsQueue)
-
+// missingPieces lists the pieces left to download, in index order
+func (ds *DownloadSession) missingPieces() []*pieceInfo {
+	var pieces []*pieceInfo
 	for i, hash := range ds.PieceHashes {
 		// check if the piece is already downloaded
 		if ds.bitfield.HasPiece(i) {
@@ -274,38 +341,60 @@ func (ds *DownloadSession) Download(ctx context.Context, filepath string) error
 		}
 
 		begin, end := ds.getPieceBoundAt(i)
-
-		piecesQueue <- &pieceInfo{
+		pieces = append(pieces, &pieceInfo{
 			index:  i,
 			hash:   hash,
 			length: end - begin,
-		}
+		})
+	}
+	return pieces
+}
+
+func (ds *DownloadSession) Download(ctx context.Context, filepath string) error {
+	left := func() int { return bytesLeft(ds.TorrentFile, ds.data.Completed()) }
+	resp, err := ds.peerInfo.announce(ds.TorrentFile, ds.swarm.counters, api.Started, left())
+	if err != nil {
+		logger.Error("Failed to announce", "error", err)
+	}
+
+	resultsQueue := make(chan *pieceResult, ds.NumPieces())
+	// defer close(resultsQueue)
+
+	// workers stop with the download
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if resp != nil {
+		ds.peerInfo.spawn(func() {
+			ds.peerInfo.announceLoop(ctx, ds.TorrentFile, ds.swarm.counters, announceInterval(resp), left)
+		})
 	}
 
-	// start retrieving pieces
+	// start retrieving pieces from every connection, including the ones
+	// peers open to us
+	ds.swarm.setOnConn(func(pc *PeerConn) {
+		ds.peerInfo.spawn(func() { ds.downloadFromConn(ctx, pc, resultsQueue) })
+	})
+	defer ds.swarm.setOnConn(nil)
 	for _, peer := range ds.peers {
-		go ds.downloadFromPeer(ctx, peer, piecesQueue, resultsQueue)
+		ds.peerInfo.spawn(func() {
+			if err := ds.peerInfo.connect(ctx, ds.swarm, peer); err != nil && !errors.Is(err, ErrSelfConn) {
+				logger.Error("Failed to connect to peer", "peer", peer.String(), "error", err)
+			}
+		})
 	}
 
 	// assemble pieces
 	// buf := make([]byte, ds.Length)
-	donePieces := 0
+	donePieces := ds.bitfield.NumPieces()
 	for donePieces < ds.NumPieces() {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-			res := <-resultsQueue
-			begin, _ := ds.getPieceBoundAt(res.index)
-			// copy(ds.buf[begin:end], res.buf)
-			_, err := ds.fd.WriteAt(res.buf, int64(begin))
-			if err != nil {
+		case res := <-resultsQueue:
+			if err := ds.writePiece(res); err != nil {
 				return err
 			}
 			donePieces++
-
-			ds.bitfield.SetPiece(res.index)
-            ds.peerInfo.cache[ds.InfoHash.String()].Bitfield.SetPiece(res.index)
 		}
 	}
 	ds.done = true
@@ -313,16 +402,65 @@ func (ds *DownloadSession) Download(ctx context.Context, filepath string) error
 	return nil
 }
 
+// writePiece stores a verified piece, it is only saved in the cache once flushed
+func (ds *DownloadSession) writePiece(res *pieceResult) error {
+	_, err := ds.data.WriteAt(res.buf, res.index, 0)
+	if err != nil {
+		return err
+	}
+	ds.data.MarkComplete(res.index)
+	ds.swarm.broadcastHave(res.index)
+
+	ds.bitfield.SetPiece(res.index)
+	ds.mu.Lock()
+	ds.unflushed = append(ds.unflushed, res.index)
+	ds.mu.Unlock()
+	ds.peerInfo.requestCheckpoint()
+	return nil
+}
+
+// commitPieces flushes the data then records the pieces written since the last call in
+// the cache, a crash must never resume from pieces that did not reach the disk
+func (ds *DownloadSession) commitPieces() error {
+	ds.mu.Lock()
+	pieces := ds.unflushed
+	ds.unflushed = nil
+	ds.mu.Unlock()
+	if len(pieces) == 0 {
+		return nil
+	}
+
+	if err := ds.data.Flush(); err != nil {
+		// committed on the next checkpoint
+		ds.mu.Lock()
+		ds.unflushed = append(pieces, ds.unflushed...)
+		ds.mu.Unlock()
+		return err
+	}
+	ds.peerInfo.cacheMu.Lock()
+	defer ds.peerInfo.cacheMu.Unlock()
+	if cache, ok := ds.peerInfo.cache[ds.InfoHash.String()]; ok {
+		for _, index := range pieces {
+			cache.Bitfield.SetPiece(index)
+		}
+	}
+	return nil
+}
+
 func (ds *DownloadSession) Close() {
-	ds.fd.Close()
+	left := bytesLeft(ds.TorrentFile, ds.data.Completed())
+	ds.data.Close()
+	ds.peerInfo.cacheMu.Lock()
 	if cache, ok := ds.peerInfo.cache[ds.InfoHash.String()]; ok {
 		cache.Bitfield = ds.bitfield
 	}
+	ds.peerInfo.cacheMu.Unlock()
 
+	event := api.Stopped
 	if ds.done {
-		ds.peerInfo.updateToTracker(ds.TorrentFile, api.Completed, 0, ds.Length)
-	} else {
-		numDownloadedPieces := ds.bitfield.NumPieces()
-		ds.peerInfo.updateToTracker(ds.TorrentFile, api.Stopped, 0, numDownloadedPieces*ds.PieceLength)
+		event = api.Completed
+	}
+	if _, err := ds.peerInfo.announce(ds.TorrentFile, ds.swarm.counters, event, left); err != nil {
+		logger.Error("Failed to announce", "error", err)
 	}
 }
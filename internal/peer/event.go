@@ -29,9 +29,76 @@ func (e *EventDownload) Handle(ctx context.Context, p *Peer) error {
 	return p.download(ctx, tf, e.DownloadPath)
 }
 
+// EventMagnet downloads the torrent of a magnet link,
+// its metainfo is first fetched from the peers
+type EventMagnet struct {
+	DownloadPath string
+	Link         string
+}
+
+func (e *EventMagnet) Name() string {
+	return "Magnet"
+}
+
+func (e *EventMagnet) Handle(ctx context.Context, p *Peer) error {
+	m, err := parseMagnet(e.Link)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.torrents.get(m.infoHash); ok {
+		return ErrTorrentExists
+	}
+	tf, err := p.fetchMetadata(ctx, m)
+	if err != nil {
+		return err
+	}
+	return p.download(ctx, tf, e.DownloadPath)
+}
+
+// EventAddExisting adds a torrent with its data already on disk,
+// the data is verified then seeded, the missing pieces are downloaded
+type EventAddExisting struct {
+	DataPath    string
+	TorrentPath string
+}
+
+func (e *EventAddExisting) Name() string {
+	return "AddExisting"
+}
+
+func (e *EventAddExisting) Handle(ctx context.Context, p *Peer) error {
+	tf, err := torrent.Open(e.TorrentPath)
+	if err != nil {
+		return err
+	}
+	return p.addExisting(ctx, tf, e.DataPath)
+}
+
+// EventCrossSeed adds a torrent reusing the matching files found in the
+// directories, the missing ones are downloaded to the download path
+type EventCrossSeed struct {
+	DownloadPath string
+	TorrentPath  string
+	Dirs         []string
+}
+
+func (e *EventCrossSeed) Name() string {
+	return "CrossSeed"
+}
+
+func (e *EventCrossSeed) Handle(ctx context.Context, p *Peer) error {
+	tf, err := torrent.Open(e.TorrentPath)
+	if err != nil {
+		return err
+	}
+	return p.crossSeed(ctx, tf, e.Dirs, e.DownloadPath)
+}
+
 type EventUpload struct {
 	FilePath    string
 	TorrentPath string
+	// Reveal the pieces one at a time to spread them faster, see BEP 16
+	SuperSeed bool
 }
 
 func (e *EventUpload) Name() string {
@@ -43,5 +110,83 @@ func (e *EventUpload) Handle(ctx context.Context, p *Peer) error {
 	if err != nil {
 		return err
 	}
-	return p.seedTorrent(ctx, tf)
+	return p.seedTorrent(ctx, tf, e.FilePath, e.SuperSeed || p.config.SuperSeeding)
+}
+
+type EventPause struct {
+	InfoHash torrent.Sha1Hash
+}
+
+func (e *EventPause) Name() string {
+	return "Pause"
+}
+
+func (e *EventPause) Handle(ctx context.Context, p *Peer) error {
+	return p.Pause(e.InfoHash)
+}
+
+type EventResume struct {
+	InfoHash torrent.Sha1Hash
+}
+
+func (e *EventResume) Name() string {
+	return "Resume"
+}
+
+func (e *EventResume) Handle(ctx context.Context, p *Peer) error {
+	return p.Resume(ctx, e.InfoHash)
+}
+
+type EventRemove struct {
+	InfoHash torrent.Sha1Hash
+	// Also delete the downloaded or seeded data
+	DeleteData bool
+}
+
+func (e *EventRemove) Name() string {
+	return "Remove"
+}
+
+func (e *EventRemove) Handle(ctx context.Context, p *Peer) error {
+	return p.Remove(e.InfoHash, e.DeleteData)
+}
+
+type EventForceStart struct {
+	InfoHash torrent.Sha1Hash
+}
+
+func (e *EventForceStart) Name() string {
+	return "ForceStart"
+}
+
+func (e *EventForceStart) Handle(ctx context.Context, p *Peer) error {
+	return p.ForceStart(ctx, e.InfoHash)
+}
+
+type EventQueuePosition struct {
+	InfoHash torrent.Sha1Hash
+	// 0 is the front of the queue
+	Position int
+}
+
+func (e *EventQueuePosition) Name() string {
+	return "QueuePosition"
+}
+
+func (e *EventQueuePosition) Handle(ctx context.Context, p *Peer) error {
+	return p.SetQueuePosition(e.InfoHash, e.Position)
+}
+
+type EventMoveStorage struct {
+	InfoHash torrent.Sha1Hash
+	// Directory the data is moved to
+	Path string
+}
+
+func (e *EventMoveStorage) Name() string {
+	return "MoveStorage"
+}
+
+func (e *EventMoveStorage) Handle(ctx context.Context, p *Peer) error {
+	return p.MoveStorage(e.InfoHash, e.Path)
 }
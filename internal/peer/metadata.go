@@ -0,0 +1,261 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/peers"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// The metainfo of a magnet link is fetched from the peers of the torrent,
+// see BEP 9, over the extension protocol of BEP 10.
+// The info dictionary is sent in pieces of 16KiB and checked against the info hash.
+
+const (
+	// id of the extended handshake
+	extHandshakeID = 0
+	// id the remote peers send us ut_metadata messages with
+	utMetadataID = 1
+
+	metadataPieceSize = 16 * 1024
+	// larger metainfo is refused
+	maxMetadataSize = 8 * 1024 * 1024
+	// how long a peer may take to send the whole metainfo
+	metadataTimeout = 30 * time.Second
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+var (
+	ErrNoMetadata          = errors.New("no peer sent the metainfo")
+	ErrMetadataUnsupported = errors.New("peer does not send the metainfo")
+	ErrMetadataRejected    = errors.New("peer rejected the metainfo request")
+	ErrMagnetNoTracker     = errors.New("magnet link has no tracker")
+)
+
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func buildExtHandshake(metadataSize int) *connection.Message {
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, extHandshake{
+		M:            map[string]int{"ut_metadata": utMetadataID},
+		MetadataSize: metadataSize,
+	})
+	return connection.BuildExtendedMsg(extHandshakeID, buf.Bytes())
+}
+
+func buildMetadataMsg(id byte, msg metadataMsg, data []byte) *connection.Message {
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, msg)
+	buf.Write(data)
+	return connection.BuildExtendedMsg(id, buf.Bytes())
+}
+
+// parseMetadataMsg returns the dictionary of a ut_metadata message and the data following it
+func parseMetadataMsg(payload []byte) (metadataMsg, []byte, error) {
+	var msg metadataMsg
+	r := bufio.NewReader(bytes.NewReader(payload))
+	if err := bencode.Unmarshal(r, &msg); err != nil {
+		return msg, nil, err
+	}
+	data, err := io.ReadAll(r)
+	return msg, data, err
+}
+
+// metadataPiece returns a piece of the info dictionary
+func metadataPiece(info []byte, piece int) ([]byte, bool) {
+	begin := piece * metadataPieceSize
+	if piece < 0 || begin >= len(info) {
+		return nil, false
+	}
+	return info[begin:min(begin+metadataPieceSize, len(info))], true
+}
+
+// sendExtHandshake tells the remote peer we send the metainfo
+func (pc *PeerConn) sendExtHandshake() {
+	pc.send(buildExtHandshake(len(pc.swarm.metadata())))
+}
+
+// handleExtended answers the metainfo requests of the remote peer
+func (pc *PeerConn) handleExtended(msg *connection.Message) {
+	id, payload, err := connection.ParseExtendedMsg(msg)
+	if err != nil {
+		return
+	}
+	switch id {
+	case extHandshakeID:
+		var hs extHandshake
+		if err := bencode.Unmarshal(bytes.NewReader(payload), &hs); err != nil {
+			return
+		}
+		pc.stateMu.Lock()
+		pc.metadataID = byte(hs.M["ut_metadata"])
+		pc.stateMu.Unlock()
+	case utMetadataID:
+		req, _, err := parseMetadataMsg(payload)
+		if err != nil || req.MsgType != metadataRequest {
+			return
+		}
+		pc.stateMu.Lock()
+		remoteID := pc.metadataID
+		pc.stateMu.Unlock()
+		if remoteID == 0 {
+			return
+		}
+		info := pc.swarm.metadata()
+		data, ok := metadataPiece(info, req.Piece)
+		if !ok {
+			pc.send(buildMetadataMsg(remoteID, metadataMsg{MsgType: metadataReject, Piece: req.Piece}, nil))
+			return
+		}
+		pc.send(buildMetadataMsg(remoteID, metadataMsg{MsgType: metadataData, Piece: req.Piece, TotalSize: len(info)}, data))
+	}
+}
+
+// fetchMetadata gets the metainfo of a magnet link from the peers its trackers return
+func (p *Peer) fetchMetadata(ctx context.Context, m *magnetLink) (*torrent.TorrentFile, error) {
+	if len(m.trackers) == 0 {
+		return nil, ErrMagnetNoTracker
+	}
+	logger.Info("Fetching metainfo", "name", m.name, "infohash", m.infoHash.String())
+	for _, announce := range m.trackers {
+		// the tracker only needs the info hash
+		stub := &torrent.TorrentFile{Announce: announce, InfoHash: m.infoHash}
+		remotes, err := stub.RequestPeers(p.PeerID, p.Port)
+		if err != nil {
+			logger.Error("Failed to request peers", "tracker", announce, "error", err)
+			continue
+		}
+		for _, remote := range remotes {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			info, err := p.fetchMetadataFrom(ctx, remote, m.infoHash)
+			if err != nil {
+				logger.Debug("Failed to fetch metainfo", "peer", remote.String(), "error", err)
+				continue
+			}
+			return torrent.FromInfo(announce, info)
+		}
+	}
+	return nil, ErrNoMetadata
+}
+
+// fetchMetadataFrom downloads the info dictionary from a single peer
+func (p *Peer) fetchMetadataFrom(ctx context.Context, remote peers.Peer, infoHash torrent.Sha1Hash) ([]byte, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// a cancelled add stops the fetch
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	res, err := completeHandshake(conn, infoHash, p.PeerID)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(res.PeerID[:], p.PeerID[:]) {
+		return nil, ErrSelfConn
+	}
+	if !res.SupportsExtensions() {
+		return nil, ErrMetadataUnsupported
+	}
+
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+	if _, err := conn.Write(buildExtHandshake(0).Serialize()); err != nil {
+		return nil, err
+	}
+
+	var info []byte
+	var received []bool
+	missing := 0
+	for {
+		msg, err := connection.ReadMsg(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != connection.MsgExtended {
+			continue
+		}
+		id, payload, err := connection.ParseExtendedMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case id == extHandshakeID && info == nil:
+			var hs extHandshake
+			if err := bencode.Unmarshal(bytes.NewReader(payload), &hs); err != nil {
+				return nil, err
+			}
+			remoteID := hs.M["ut_metadata"]
+			if remoteID <= 0 || remoteID > 255 || hs.MetadataSize <= 0 {
+				return nil, ErrMetadataUnsupported
+			}
+			if hs.MetadataSize > maxMetadataSize {
+				return nil, fmt.Errorf("Metainfo of %d bytes is too large", hs.MetadataSize)
+			}
+			info = make([]byte, hs.MetadataSize)
+			missing = (hs.MetadataSize + metadataPieceSize - 1) / metadataPieceSize
+			received = make([]bool, missing)
+			for piece := range received {
+				req := buildMetadataMsg(byte(remoteID), metadataMsg{MsgType: metadataRequest, Piece: piece}, nil)
+				if _, err := conn.Write(req.Serialize()); err != nil {
+					return nil, err
+				}
+			}
+		case id == utMetadataID && info != nil:
+			res, data, err := parseMetadataMsg(payload)
+			if err != nil {
+				return nil, err
+			}
+			if res.MsgType == metadataReject {
+				return nil, ErrMetadataRejected
+			}
+			if res.MsgType != metadataData {
+				continue
+			}
+			want, ok := metadataPiece(info, res.Piece)
+			if !ok || len(data) != len(want) || received[res.Piece] {
+				return nil, ErrInvalidMessage
+			}
+			copy(want, data)
+			received[res.Piece] = true
+			missing--
+			if missing == 0 {
+				if sha1.Sum(info) != infoHash {
+					return nil, ErrInfoHashMismatch
+				}
+				return info, nil
+			}
+		}
+	}
+}
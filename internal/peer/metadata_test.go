@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/peers"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestMagnetDownload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	// enough pieces for the info dictionary to take two metadata pieces
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1100)
+	seedPath := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(seedPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 16)
+	tf.Announce = tracker.URL
+	info, err := tf.InfoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) <= metadataPieceSize {
+		t.Fatalf("Expected the metainfo to take several pieces, got %d bytes", len(info))
+	}
+	tf.InfoHash = sha1.Sum(info)
+
+	// a peer with the same info hash but another metainfo does not send it
+	other := *tf
+	other.Name = "other.bin"
+	bad := newTestPeer(t, filepath.Join(dir, "bad.json"))
+	bad.PeerID = [20]byte{3}
+	bad.Port = freePort(t)
+	go bad.Run(ctx)
+	go bad.seedTorrent(ctx, &other, seedPath, false)
+	waitForState(t, bad, tf.InfoHash, StateSeeding)
+
+	seeder := newTestPeer(t, filepath.Join(dir, "seeder.json"))
+	seeder.Port = freePort(t)
+	go seeder.Run(ctx)
+	go seeder.seedTorrent(ctx, tf, seedPath, false)
+	waitForState(t, seeder, tf.InfoHash, StateSeeding)
+	badPeer := peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: bad.Port}
+	tracker.setPeers(badPeer, peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: seeder.Port})
+
+	leecher := newTestPeer(t, filepath.Join(dir, "leecher.json"))
+	leecher.PeerID = [20]byte{2}
+	if _, err := leecher.fetchMetadataFrom(ctx, badPeer, tf.InfoHash); err != ErrMetadataUnsupported {
+		t.Errorf("Expected ErrMetadataUnsupported, got %v", err)
+	}
+	link := "magnet:?xt=urn:btih:" + tf.InfoHash.String() + "&tr=" + url.QueryEscape(tracker.URL)
+	m, err := parseMagnet(link)
+	if err != nil {
+		t.Fatalf("Failed to parse magnet link: %s", err)
+	}
+	fetched, err := leecher.fetchMetadata(ctx, m)
+	if err != nil {
+		t.Fatalf("Failed to fetch metainfo: %s", err)
+	}
+	if fetched.InfoHash != tf.InfoHash || fetched.Name != tf.Name || fetched.Length != tf.Length || fetched.NumPieces() != tf.NumPieces() {
+		t.Errorf("Expected the metainfo of the seeder, got %s %s %d", fetched.InfoHash, fetched.Name, fetched.Length)
+	}
+	if fetched.Announce != tracker.URL {
+		t.Errorf("Expected the tracker of the magnet link, got %s", fetched.Announce)
+	}
+
+	leecher.config.SeedOnFileDownloaded = true
+	go (&EventMagnet{DownloadPath: filepath.Join(dir, "downloads"), Link: link}).Handle(ctx, leecher)
+	waitForState(t, leecher, tf.InfoHash, StateSeeding)
+	mt, _ := leecher.torrents.get(tf.InfoHash)
+	got, err := os.ReadFile(mt.info().Path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the downloaded data to match (%v)", err)
+	}
+}
+
+func TestFetchMetadataNoTracker(t *testing.T) {
+	p := newTestPeer(t, filepath.Join(t.TempDir(), "cache.json"))
+	m := &magnetLink{infoHash: torrent.Sha1Hash{1}}
+	if _, err := p.fetchMetadata(context.Background(), m); err != ErrMagnetNoTracker {
+		t.Errorf("Expected ErrMagnetNoTracker, got %v", err)
+	}
+}
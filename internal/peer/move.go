@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/common/utils"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+// relocatableData is the data of a seeded torrent that can be moved
+// while its connections stay open, the I/O waits during the move
+type relocatableData struct {
+	mu sync.RWMutex
+	storage.Torrent
+}
+
+func (d *relocatableData) ReadAt(b []byte, piece int, begin int) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.ReadAt(b, piece, begin)
+}
+
+func (d *relocatableData) WriteAt(b []byte, piece int, begin int) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.WriteAt(b, piece, begin)
+}
+
+func (d *relocatableData) MarkComplete(piece int) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.MarkComplete(piece)
+}
+
+func (d *relocatableData) Completed() connection.BitField {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.Completed()
+}
+
+func (d *relocatableData) Flush() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.Flush()
+}
+
+func (d *relocatableData) Close() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Torrent.Close()
+}
+
+// relocate replaces the data with the one returned by fn, which may be the old one on error
+func (d *relocatableData) relocate(fn func(old storage.Torrent) (storage.Torrent, error)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := fn(d.Torrent)
+	d.Torrent = data
+	return err
+}
+
+// openComplete opens the complete data of a seeded torrent
+func (p *Peer) openComplete(tf *torrent.TorrentFile, path string) (storage.Torrent, error) {
+	// opening creates the missing files
+	if err := storage.CheckComplete(tf, path); err != nil {
+		return nil, err
+	}
+	data, err := p.storage.Open(tf, path)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < tf.NumPieces(); i++ {
+		data.MarkComplete(i)
+	}
+	return data, nil
+}
+
+// MoveStorage moves the data of a seeded torrent to the directory, a running seed
+// keeps its connections and tracker session and continues from the new location
+func (p *Peer) MoveStorage(infoHash torrent.Sha1Hash, dir string) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	// a second move waits, then starts from where the first one left the data
+	mt.moveMu.Lock()
+	defer mt.moveMu.Unlock()
+	mt.mu.Lock()
+	seeding, superSeed, src := mt.seeding, mt.superSeed, mt.dataPath
+	mt.mu.Unlock()
+	if !seeding {
+		return fmt.Errorf("Cannot move a torrent that is not downloaded yet")
+	}
+	dest := filepath.Join(dir, filepath.Base(src))
+	if dest == src {
+		return nil
+	}
+
+	// a seed ended by a pause, a removal or its limits clears the swarm once its data is closed
+	state, sw := mt.State(), mt.getSwarm()
+	if state == StateSeeding && sw == nil {
+		state = StatePaused
+	}
+	switch state {
+	case StateSeeding:
+		data, ok := sw.data.(*relocatableData)
+		if !ok {
+			return fmt.Errorf("Cannot move the data of this torrent")
+		}
+		// set when the data could not be opened again, wherever it is
+		var lost string
+		err := data.relocate(func(old storage.Torrent) (storage.Torrent, error) {
+			if err := old.Flush(); err != nil {
+				return old, err
+			}
+			old.Close()
+			if err := utils.MovePath(src, dest); err != nil {
+				// the source is only removed once moved
+				reopened, rerr := p.openComplete(mt.TorrentFile, src)
+				if rerr != nil {
+					lost = src
+					return old, rerr
+				}
+				return reopened, err
+			}
+			moved, err := p.openComplete(mt.TorrentFile, dest)
+			if err != nil {
+				lost = dest
+				return old, err
+			}
+			return moved, nil
+		})
+		if lost != "" {
+			// the closed data cannot be seeded anymore
+			mt.stop()
+			mt.seed(lost, superSeed)
+			mt.fail(err)
+			p.cacheSeed(mt)
+			if err := p.saveCache(); err != nil {
+				logger.Error("Failed to save cache", "error", err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	case StatePaused, StateError:
+		if err := utils.MovePath(src, dest); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Cannot move a torrent that is %s", state)
+	}
+
+	logger.Info("Moved torrent data", "infohash", infoHash.String(), "from", src, "to", dest)
+	mt.seed(dest, superSeed)
+	p.cacheSeed(mt)
+	return p.saveCache()
+}
@@ -0,0 +1,202 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/api"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+func TestMoveStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "old", "file.bin")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	tf.InfoHash = torrent.Sha1Hash{0xef}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	go p.seedTorrent(ctx, tf, path, false)
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	// the started announce follows
+	for tracker.lastAnnounce().Get("event") != string(api.Started) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tracker.mu.Lock()
+	announces := len(tracker.announces)
+	tracker.mu.Unlock()
+	sw := p.torrents.swarm(tf.InfoHash)
+
+	newDir := filepath.Join(dir, "new")
+	if err := p.MoveStorage(tf.InfoHash, newDir); err != nil {
+		t.Fatalf("Failed to move storage: %s", err)
+	}
+	moved := filepath.Join(newDir, "file.bin")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the old data to be removed, got %v", err)
+	}
+
+	// the same session serves the pieces from the new location
+	if p.torrents.swarm(tf.InfoHash) != sw {
+		t.Errorf("Expected the seed to keep running")
+	}
+	buf := make([]byte, 4)
+	if _, err := sw.data.ReadAt(buf, 1, 0); err != nil || string(buf) != "4567" {
+		t.Errorf("Expected to read the second piece, got %q (%v)", buf, err)
+	}
+	tracker.mu.Lock()
+	if n := len(tracker.announces); n != announces {
+		t.Errorf("Expected no new announce, got %d", n-announces)
+	}
+	tracker.mu.Unlock()
+
+	mt, _ := p.torrents.get(tf.InfoHash)
+	if info := mt.info(); info.Path != moved || info.State != StateSeeding {
+		t.Errorf("Expected seeding from %s, got %s from %s", moved, info.State, info.Path)
+	}
+	if cached := p.cache[tf.InfoHash.String()].Filepath; cached != moved {
+		t.Errorf("Expected the cache to point to %s, got %s", moved, cached)
+	}
+
+	// paused torrents are moved too
+	if err := p.Pause(tf.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	// an existing file is never overwritten
+	taken := filepath.Join(dir, "taken")
+	if err := os.MkdirAll(taken, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(taken, "file.bin"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.MoveStorage(tf.InfoHash, taken); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected os.ErrExist, got %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(taken, "file.bin")); string(got) != "other" {
+		t.Errorf("Expected the existing file to be kept, got %q", got)
+	}
+	if got, err := os.ReadFile(moved); err != nil || string(got) != string(data) {
+		t.Errorf("Expected the data to stay in place, got %q (%v)", got, err)
+	}
+	if err := p.MoveStorage(tf.InfoHash, dir); err != nil {
+		t.Fatalf("Failed to move paused torrent: %s", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || string(got) != string(data) {
+		t.Errorf("Expected the data to be moved, got %q (%v)", got, err)
+	}
+	if err := p.MoveStorage(torrent.Sha1Hash{1}, dir); err != ErrTorrentNotFound {
+		t.Errorf("Expected ErrTorrentNotFound, got %v", err)
+	}
+}
+
+func TestOpenCompleteMissing(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	st := storage.NewDiskIO(storage.NewFileStorage(), storage.DiskIOConfig{Preallocation: storage.PreallocateSparse})
+	t.Cleanup(func() { st.Close() })
+	// the sparse file would look complete
+	p.storage = st
+	tf := testTorrent([]byte("0123456789"), 4)
+
+	path := filepath.Join(dir, "file.bin")
+	if _, err := p.openComplete(tf, path); !os.IsNotExist(err) {
+		t.Errorf("Expected missing data to fail, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no file to be created, got %v", err)
+	}
+}
+
+func TestMoveStorageConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	mt, err := p.torrents.add(tf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt.seed(path, false)
+	mt.setState(StatePaused)
+
+	// each move starts from where the previous one left the data
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- p.MoveStorage(tf.InfoHash, filepath.Join(dir, string(rune('a'+i))))
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Failed to move storage: %s", err)
+		}
+	}
+	info := mt.info()
+	if got, err := os.ReadFile(info.Path); err != nil || string(got) != string(data) {
+		t.Errorf("Expected the data at %s, got %q (%v)", info.Path, got, err)
+	}
+	if cached := p.cache[tf.InfoHash.String()].Filepath; cached != info.Path {
+		t.Errorf("Expected the cache to point to %s, got %s", info.Path, cached)
+	}
+}
+
+func TestMoveStorageWhilePausing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	go p.seedTorrent(ctx, tf, path, false)
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	mt, _ := p.torrents.get(tf.InfoHash)
+
+	paused := make(chan error, 1)
+	go func() { paused <- p.Pause(tf.InfoHash) }()
+	if err := p.MoveStorage(tf.InfoHash, filepath.Join(dir, "moved")); err != nil {
+		t.Errorf("Failed to move storage: %s", err)
+	}
+	if err := <-paused; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(mt.info().Path); err != nil || string(got) != string(data) {
+		t.Errorf("Expected the data at %s, got %q (%v)", mt.info().Path, got, err)
+	}
+
+	// the seed ended between reading its state and its swarm
+	mt.activate(StateSeeding, nil, nil)
+	if err := p.MoveStorage(tf.InfoHash, filepath.Join(dir, "again")); err != nil {
+		t.Fatalf("Failed to move storage: %s", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "again", "file.bin")); err != nil || string(got) != string(data) {
+		t.Errorf("Expected the data to be moved, got %q (%v)", got, err)
+	}
+}
@@ -3,28 +3,55 @@ package peer
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/chezzijr/p2p/internal/common/api"
 	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/common/utils"
+	"github.com/chezzijr/p2p/internal/peer/storage"
 	"github.com/jackpal/bencode-go"
 )
 
 type Peer struct {
 	config           *Config
 	cache            CachedFilesMap
+	cacheMu          sync.Mutex
+	// serializes the saves of the cache
+	saveMu           sync.Mutex
+	// requests a save of the cache, see checkpointLoop
+	checkpoint       chan struct{}
 	events           chan Event
 	connectingPeers  map[string]net.Conn
-	downloadingPeers map[string]*DownloadSession
-	uploadingPeers   map[string]*UploadSession
-	seedingTorrents  map[string]*torrent.TorrentFile
+	// every torrent of the peer, whatever its state
+	torrents         *registry
+	queue            *torrentQueue
+	// restored from the cache by NewPeer, started by Run
+	restored         []restoredTorrent
+	storage          *storage.DiskIO
 	done             chan struct{}
+	// every goroutine of the peer, Run waits for them on shutdown
+	wg               sync.WaitGroup
+
+	// bandwidth limits, global and per torrent
+	uploadLimiter   *RateLimiter
+	downloadLimiter *RateLimiter
+	torrentLimiters map[string]*torrentLimiters
+	// the global limits outside of the schedule rules, see SetRateLimits
+	uploadRate      int
+	downloadRate    int
+	limitersMu      sync.Mutex
+	scheduler       *scheduler
+
+	// decides which connections are unchoked
+	choker *choker
 
 	PeerID [20]byte
 	Port   uint16
@@ -48,20 +75,49 @@ func NewPeer(port uint16) (*Peer, error) {
 		return nil, err
 	}
 
+	backend, err := storage.New(cfg.StorageBackend)
+	if err != nil {
+		return nil, err
+	}
+	st := storage.NewDiskIO(backend, storage.DiskIOConfig{
+		Workers:        cfg.DiskIOWorkers,
+		WriteCacheSize: cfg.DiskWriteCacheSize,
+		ReadCacheSize:  cfg.DiskReadCacheSize,
+		Preallocation:  cfg.Preallocation,
+	})
+
 	InitLogger(os.Stderr)
 
-	return &Peer{
+	p := &Peer{
 		config:           cfg,
 		cache:            cache,
+		checkpoint:       make(chan struct{}, 1),
 		events:           make(chan Event, 10),
 		connectingPeers:  make(map[string]net.Conn),
-		downloadingPeers: make(map[string]*DownloadSession),
-		uploadingPeers:   make(map[string]*UploadSession),
-		seedingTorrents:  make(map[string]*torrent.TorrentFile),
+		torrents:         newRegistry(),
+		queue:            newTorrentQueue(cfg.MaxActiveDownloads, cfg.MaxActiveSeeds),
+		storage:          st,
         // done:             make(chan struct{}, 1),
+		uploadLimiter:    NewRateLimiter(cfg.MaxUploadRate),
+		downloadLimiter:  NewRateLimiter(cfg.MaxDownloadRate),
+		uploadRate:       cfg.MaxUploadRate,
+		downloadRate:     cfg.MaxDownloadRate,
+		torrentLimiters:  make(map[string]*torrentLimiters),
+		choker:           newChoker(realClock{}, cfg.UploadSlots),
 		PeerID:           peerID,
 		Port:             port,
-	}, nil
+	}
+
+	if len(cfg.Schedule) > 0 {
+		p.scheduler, err = newScheduler(cfg.Schedule, realClock{}, p.applySchedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.restoreSession()
+
+	return p, nil
 }
 
 // Write downloaded data to file.ext.tmp, where file.ext is the file name
@@ -69,33 +125,130 @@ func NewPeer(port uint16) (*Peer, error) {
 // This function is a goroutine
 func (p *Peer) download(ctx context.Context, t *torrent.TorrentFile, filepath string) error {
     logger.Info("Downloading torrent", "Info hash", t.InfoHash.String())
-	session, err := p.NewDownloadSession(t, filepath)
+	filepath = p.downloadDir(filepath)
+	mt, err := p.torrents.add(t, filepath)
+	if p.addedRestored(t, err) {
+		logger.Info("Torrent already restored", "infohash", t.InfoHash.String())
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer func() {
-		session.Close()
-		delete(p.downloadingPeers, t.InfoHash.String())
-		// rename file
-		if session.done {
-			os.Rename(filepath+t.Name+".tmp", filepath+t.Name)
+	if err := p.cacheTorrent(mt); err != nil {
+		logger.Error("Failed to cache torrent", "error", err)
+	}
+	// paused torrents stay paused across restarts
+	if p.restoreTorrent(mt) {
+		mt.setState(StatePaused)
+		return nil
+	}
+	return p.runTorrent(ctx, mt)
+}
+
+// runTorrent downloads or seeds the torrent until it is done or stopped
+func (p *Peer) runTorrent(ctx context.Context, mt *managedTorrent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	if !mt.start(cancel) {
+		cancel()
+		return fmt.Errorf("Torrent is already running")
+	}
+	defer mt.finish()
+	defer p.queue.release(mt)
+
+	for {
+		mt.mu.Lock()
+		seeding, superSeed, path := mt.seeding, mt.superSeed, mt.path
+		mt.mu.Unlock()
+
+		kind := queueDownload
+		if seeding {
+			kind = queueSeed
 		}
-		// seed the file
-		if session.done && p.config.SeedOnFileDownloaded {
-			go p.seedTorrent(ctx, t)
+		err := p.queue.acquire(ctx, mt, kind)
+		if err == nil {
+			if seeding {
+				err = p.runSeed(ctx, mt, path, superSeed)
+			} else {
+				err = p.runDownload(ctx, mt, path)
+			}
 		}
-	}()
+		// a finished download joins the back of the queue of seeds
+		p.queue.release(mt)
+		// the state is up to whoever stopped it
+		if mt.isStopped() {
+			return nil
+		}
+		// the peer is shutting down, the torrent is kept so that
+		// its progress is saved and it is restored on start
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errSeedLimitReached) {
+			return p.finishSeeding(mt)
+		}
+		if err != nil {
+			mt.fail(err)
+			return err
+		}
+		if seeding || !p.config.SeedOnFileDownloaded {
+			p.torrents.remove(mt)
+			p.removeTorrentLimiters(mt.InfoHash)
+			// a finished download is not restored
+			if !seeding {
+				p.forgetCached(mt.InfoHash)
+			}
+			return nil
+		}
+		// seed the file from where it was moved
+		mt.mu.Lock()
+		dataPath := mt.dataPath
+		mt.mu.Unlock()
+		mt.seed(dataPath, false)
+		p.cacheSeed(mt)
+	}
+}
+
+func (p *Peer) runDownload(ctx context.Context, mt *managedTorrent, filepath string) error {
+	t := mt.TorrentFile
+	session, err := p.NewDownloadSession(t, filepath)
+	if err != nil {
+		return err
+	}
+	mt.setDataPath(session.dataPath)
+
+	// peers may connect to us while downloading, the verified pieces are served
+	// when seeding on piece downloaded, and always from data given by the user
+	incomplete := p.isIncompleteData(t, filepath, session.dataPath)
+	upload := p.config.SeedOnPieceDownloaded || !incomplete
+	session.swarm = newSwarm(t, session.data, p.PeerID, upload)
+	session.swarm.counters = &mt.counters
+	mt.activate(StateDownloading, session.swarm, session)
 
 	err = session.Download(ctx, filepath)
+	session.swarm.close()
+	session.Close()
 	if err != nil {
 		slog.Error("Failed to download", "error", err)
 		return err
 	}
 
+	// move the data the peer created to its final location, where it is seeded from,
+	// the data given by the user is seeded where it is
+	dest := session.dataPath
+	if incomplete {
+		dest = p.completedPath(t, filepath)
+		if err := utils.MovePath(session.dataPath, dest); err != nil {
+			return fmt.Errorf("Failed to move the downloaded data: %w", err)
+		}
+	}
+	mt.mu.Lock()
+	mt.dataPath = dest
+	mt.downloaded = true
+	mt.mu.Unlock()
 	return nil
 }
 
-func (s *Peer) updateToTracker(t *torrent.TorrentFile, event api.AnnounceEvent, uploadSize, downloadSize int) (*api.AnnounceResponse, error) {
+func (s *Peer) updateToTracker(t *torrent.TorrentFile, event api.AnnounceEvent, uploadSize, downloadSize, left int) (*api.AnnounceResponse, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return nil, err
@@ -106,13 +259,13 @@ func (s *Peer) updateToTracker(t *torrent.TorrentFile, event api.AnnounceEvent,
 		Port:       s.Port,
 		Uploaded:   uploadSize,
 		Downloaded: downloadSize,
-		Left:       int(t.Length) - downloadSize,
+		Left:       left,
 		Event:      event,
 	}
 	base.RawQuery = req.ToUrlValues().Encode()
 	trackerUrl := base.String()
 
-	resp, err := http.Get(trackerUrl)
+	resp, err := trackerClient.Get(trackerUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -132,36 +285,155 @@ func (s *Peer) updateToTracker(t *torrent.TorrentFile, event api.AnnounceEvent,
 }
 
 // New event-driven architecture
-func (p *Peer) seedTorrent(ctx context.Context, tf *torrent.TorrentFile) error {
-	p.seedingTorrents[tf.InfoHash.String()] = tf
-	defer delete(p.seedingTorrents, tf.InfoHash.String())
+// The path is where the complete data of the torrent is stored
+func (p *Peer) seedTorrent(ctx context.Context, tf *torrent.TorrentFile, path string, superSeed bool) error {
+	mt, err := p.torrents.add(tf, path)
+	if p.addedRestored(tf, err) {
+		logger.Info("Torrent already restored", "infohash", tf.InfoHash.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mt.seed(path, superSeed)
+	paused := p.restoreTorrent(mt)
+	p.cacheSeed(mt)
+	if err := p.cacheTorrent(mt); err != nil {
+		logger.Error("Failed to cache torrent", "error", err)
+	}
+	if paused {
+		mt.setState(StatePaused)
+		return nil
+	}
+	return p.runTorrent(ctx, mt)
+}
 
-	resp, err := p.updateToTracker(tf, api.Started, 0, int(tf.Length))
+func (p *Peer) runSeed(ctx context.Context, mt *managedTorrent, path string, superSeed bool) error {
+	tf := mt.TorrentFile
+	complete, err := p.openComplete(tf, path)
 	if err != nil {
 		return err
 	}
-	// resp.Interval in minutes
-	interval := time.Minute * resp.Interval
+	// see MoveStorage
+	data := &relocatableData{Torrent: complete}
+	defer data.Close()
+
+	sw := newSwarm(tf, data, p.PeerID, true)
+	if superSeed {
+		sw.superSeed = newSuperSeeder(tf.NumPieces())
+	}
+	sw.counters = &mt.counters
+	mt.activate(StateSeeding, sw, nil)
+	defer sw.close()
 
+	mt.startSeedClock(time.Now())
+	defer func() { mt.stopSeedClock(time.Now()) }()
+	if p.seedLimitExceeded(mt) {
+		return errSeedLimitReached
+	}
+
+	resp, err := p.announce(tf, sw.counters, api.Started, 0)
+	if err != nil {
+		return err
+	}
+	p.spawn(func() {
+		p.announceLoop(ctx, tf, sw.counters, announceInterval(resp), func() int { return 0 })
+	})
+
+	check := time.NewTicker(seedLimitInterval)
+	defer check.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			_, err = p.updateToTracker(tf, api.Stopped, 0, 0)
+			_, err = p.announce(tf, sw.counters, api.Stopped, 0)
 			return err
-		case <-time.After(interval):
-			resp, err = p.updateToTracker(tf, api.Started, 0, int(tf.Length))
-			if err != nil {
-				return err
+		case <-check.C:
+			if p.seedLimitExceeded(mt) {
+				p.announce(tf, sw.counters, api.Stopped, 0)
+				return errSeedLimitReached
 			}
 		}
 	}
 }
 
+// Pause stops a torrent until it is resumed, even across restarts
+func (p *Peer) Pause(infoHash torrent.Sha1Hash) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.stop()
+	mt.setState(StatePaused)
+	p.setCachedPaused(mt, true)
+	return p.saveCache()
+}
+
+// Resume restarts a paused or failed torrent, it returns when the torrent
+// is done or stopped again
+func (p *Peer) Resume(ctx context.Context, infoHash torrent.Sha1Hash) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	if state := mt.State(); state != StatePaused && state != StateError {
+		return fmt.Errorf("Cannot resume a torrent that is %s", state)
+	}
+
+	p.setCachedPaused(mt, false)
+	if err := p.saveCache(); err != nil {
+		return err
+	}
+
+	return p.runTorrent(ctx, mt)
+}
+
+// Remove stops a torrent and forgets it, deleting its data if asked to
+func (p *Peer) Remove(infoHash torrent.Sha1Hash, deleteData bool) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.stop()
+	p.torrents.remove(mt)
+	p.removeTorrentLimiters(infoHash)
+
+	cache, cached := p.forgetCached(infoHash)
+	if err := p.saveCache(); err != nil {
+		return err
+	}
+
+	if !deleteData {
+		return nil
+	}
+	mt.mu.Lock()
+	dataPath := mt.dataPath
+	mt.mu.Unlock()
+	// a paused download was never opened since the restart
+	if dataPath == "" && cached {
+		dataPath = cache.Filepath
+	}
+	if dataPath == "" {
+		return nil
+	}
+	return os.RemoveAll(dataPath)
+}
+
 // Control the peer
 func (p *Peer) RegisterEvent(e Event) {
 	p.events <- e
 }
 
+// spawn runs fn in a goroutine that shutdown waits for
+func (p *Peer) spawn(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+	}()
+}
+
+// Run handles the events and the incoming connections until the context is done,
+// then it returns once every goroutine of the peer has exited
 func (p *Peer) Run(ctx context.Context) error {
 	var lc net.ListenConfig
 	lis, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", p.Port))
@@ -170,42 +442,80 @@ func (p *Peer) Run(ctx context.Context) error {
 	}
 	defer lis.Close()
 
-	go func(listener net.Listener) {
+	if p.scheduler != nil {
+		p.spawn(func() { p.scheduler.run(ctx) })
+	}
+	p.spawn(func() { p.choker.run(ctx) })
+
+	for _, r := range p.restored {
+		p.spawn(func() { p.startRestored(ctx, r.mt, r.check) })
+	}
+	p.restored = nil
+
+	if p.config.CheckpointInterval > 0 {
+		p.spawn(func() {
+			p.checkpointLoop(ctx, time.Duration(p.config.CheckpointInterval)*time.Second)
+		})
+	}
+
+	if dir := p.config.WatchDir; dir != "" {
+		p.spawn(func() {
+			if err := p.watchLoop(ctx, dir); err != nil {
+				logger.Error("Failed to watch directory", "dir", dir, "error", err)
+			}
+		})
+	}
+
+	if addr := p.config.ControlAddr; addr != "" {
+		p.spawn(func() {
+			if err := p.serveControl(ctx, addr); err != nil {
+				logger.Error("Failed to serve control API", "addr", addr, "error", err)
+			}
+		})
+	}
+
+	p.spawn(func() {
 		for {
-			conn, err := listener.Accept()
+			conn, err := lis.Accept()
 			if err != nil {
-				slog.Error("Failed to accept connection", "error", err)
+				// closed on shutdown
+				if ctx.Err() == nil {
+					slog.Error("Failed to accept connection", "error", err)
+				}
 				return
 			}
-			go p.handleConn(conn)
+			p.spawn(func() { p.handleConn(ctx, conn) })
 		}
-	}(lis)
+	})
 
 	// Waiting for events
 	for {
 		select {
 		case <-ctx.Done():
+			lis.Close()
+			p.wg.Wait()
 			return nil
 		case e := <-p.events:
-			go func() {
+			p.spawn(func() {
 				logger.Info("Handling event", "event", e.Name())
 				err := e.Handle(ctx, p)
 				if err != nil {
 					logger.Error("Failed to handle event", "event", e.Name(), "error", err)
 				}
-			}()
+			})
 		}
 	}
 }
 
-// graceful shutdown
+// graceful shutdown, once Run returned the torrents are stopped
+// and their data closed, what is left is saving the cache and flushing the storage
 func (p *Peer) Close() {
 	logger.Info("Closing peer")
-	for _, session := range p.downloadingPeers {
-		session.Close()
-	}
-	// save cache
-	p.cache.SaveCache(p.config.CachePath)
+	// for the peers closed without running
+	p.wg.Wait()
 
-	time.Sleep(time.Second * 3)
+	if err := p.saveCache(); err != nil {
+		logger.Error("Failed to save cache", "error", err)
+	}
+	p.storage.Close()
 }
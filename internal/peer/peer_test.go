@@ -0,0 +1,284 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/api"
+	"github.com/chezzijr/p2p/internal/common/peers"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+	"github.com/jackpal/bencode-go"
+)
+
+// fakeTracker records the announces and answers with the peers set
+type fakeTracker struct {
+	*httptest.Server
+	mu        sync.Mutex
+	announces []url.Values
+	peers     []peers.Peer
+}
+
+func newFakeTracker(t *testing.T) *fakeTracker {
+	ft := &fakeTracker{}
+	ft.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ft.mu.Lock()
+		ft.announces = append(ft.announces, r.URL.Query())
+		compact := peers.Marshal(ft.peers...)
+		ft.mu.Unlock()
+		bencode.Marshal(w, api.AnnounceResponse{Interval: 30, Peers: string(compact)})
+	}))
+	t.Cleanup(ft.Close)
+	return ft
+}
+
+func (ft *fakeTracker) setPeers(ps ...peers.Peer) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.peers = ps
+}
+
+func (ft *fakeTracker) lastAnnounce() url.Values {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if len(ft.announces) == 0 {
+		return url.Values{}
+	}
+	return ft.announces[len(ft.announces)-1]
+}
+
+func newTestPeer(t *testing.T, cachePath string) *Peer {
+	t.Helper()
+	cache, err := LoadCache(cachePath)
+	if err != nil {
+		t.Fatalf("Failed to load cache: %s", err)
+	}
+	st := storage.NewDiskIO(storage.NewFileStorage(), storage.DiskIOConfig{})
+	t.Cleanup(func() { st.Close() })
+	return &Peer{
+		config:   &Config{CachePath: cachePath},
+		cache:    cache,
+		torrents: newRegistry(),
+		queue:    newTorrentQueue(0, 0),
+		storage:  st,
+		choker:   newChoker(realClock{}, 1),
+		PeerID:   [20]byte{1},
+
+		uploadLimiter:   NewRateLimiter(0),
+		downloadLimiter: NewRateLimiter(0),
+		torrentLimiters: make(map[string]*torrentLimiters),
+	}
+}
+
+func waitForState(t *testing.T, p *Peer, infoHash torrent.Sha1Hash, state TorrentState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if mt, ok := p.torrents.get(infoHash); ok && mt.State() == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected the torrent to be %s", state)
+}
+
+func TestPauseResumeRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	tf.InfoHash = torrent.Sha1Hash{0xab}
+	cachePath := filepath.Join(dir, "cache.json")
+
+	p := newTestPeer(t, cachePath)
+	seeded := make(chan error, 1)
+	go func() { seeded <- p.seedTorrent(ctx, tf, path, false) }()
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+
+	if err := p.Pause(tf.InfoHash); err != nil {
+		t.Fatalf("Failed to pause: %s", err)
+	}
+	if err := <-seeded; err != nil {
+		t.Errorf("Expected seeding to stop cleanly, got %s", err)
+	}
+	if info := p.Torrents()[0]; info.State != StatePaused {
+		t.Errorf("Expected paused, got %s", info.State)
+	}
+	if ev := tracker.lastAnnounce().Get("event"); ev != string(api.Stopped) {
+		t.Errorf("Expected stopped announce, got %q", ev)
+	}
+
+	// still paused after a restart
+	p = newTestPeer(t, cachePath)
+	if err := p.seedTorrent(ctx, tf, path, false); err != nil {
+		t.Fatalf("Failed to add paused torrent: %s", err)
+	}
+	waitForState(t, p, tf.InfoHash, StatePaused)
+
+	resumed := make(chan error, 1)
+	go func() { resumed <- p.Resume(ctx, tf.InfoHash) }()
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	if err := p.Resume(ctx, tf.InfoHash); err == nil {
+		t.Errorf("Expected an error resuming a seeding torrent")
+	}
+	if p.cache[tf.InfoHash.String()].Paused {
+		t.Errorf("Expected the torrent not to be paused anymore")
+	}
+
+	p.SetTorrentRateLimits(tf.InfoHash, 100, 100)
+	if err := p.Remove(tf.InfoHash, true); err != nil {
+		t.Fatalf("Failed to remove: %s", err)
+	}
+	if n := len(p.torrentLimiters); n != 0 {
+		t.Errorf("Expected the limiters of the torrent to be removed, got %d", n)
+	}
+	if err := <-resumed; err != nil {
+		t.Errorf("Expected seeding to stop cleanly, got %s", err)
+	}
+	if n := len(p.Torrents()); n != 0 {
+		t.Errorf("Expected no torrents, got %d", n)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the data to be deleted, got %v", err)
+	}
+	if err := p.Pause(tf.InfoHash); err != ErrTorrentNotFound {
+		t.Errorf("Expected ErrTorrentNotFound, got %v", err)
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	torrentPath := filepath.Join(dir, "file.torrent")
+	if err := tf.Save(torrentPath); err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "cache.json")
+
+	p := newTestPeer(t, cachePath)
+	p.events = make(chan Event, 1)
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+	p.RegisterEvent(&EventUpload{FilePath: path, TorrentPath: torrentPath})
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Run to return after the context is done")
+	}
+	if ev := tracker.lastAnnounce().Get("event"); ev != string(api.Stopped) {
+		t.Errorf("Expected stopped announce, got %q", ev)
+	}
+	// kept so that it is restored
+	if _, ok := p.torrents.get(tf.InfoHash); !ok {
+		t.Errorf("Expected the torrent to be kept on shutdown")
+	}
+
+	p.Close()
+	cache, err := LoadCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf, ok := cache[tf.InfoHash.String()]; !ok || !cf.Seeding {
+		t.Errorf("Expected the seed to be saved, got %+v", cf)
+	}
+}
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return uint16(lis.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDownloadDirectories(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef01")
+	seedPath := filepath.Join(dir, "seed", "file.bin")
+	if err := os.MkdirAll(filepath.Dir(seedPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(seedPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	tf.InfoHash = torrent.Sha1Hash{0xde}
+
+	seeder := newTestPeer(t, filepath.Join(dir, "seeder.json"))
+	seeder.Port = freePort(t)
+	go seeder.Run(ctx)
+	go seeder.seedTorrent(ctx, tf, seedPath, false)
+	waitForState(t, seeder, tf.InfoHash, StateSeeding)
+	tracker.setPeers(peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: seeder.Port})
+
+	leecher := newTestPeer(t, filepath.Join(dir, "leecher.json"))
+	leecher.PeerID = [20]byte{2}
+	leecher.config.SeedOnFileDownloaded = true
+	leecher.config.DownloadDir = filepath.Join(dir, "downloads")
+	leecher.config.IncompleteDir = filepath.Join(dir, "incomplete")
+	leecher.config.CompletedDir = filepath.Join(dir, "completed")
+	go leecher.download(ctx, tf, "")
+	waitForState(t, leecher, tf.InfoHash, StateSeeding)
+
+	completed := filepath.Join(dir, "completed", tf.Name)
+	got, err := os.ReadFile(completed)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("Expected the data in the completed directory, got %q (%v)", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "incomplete", tf.Name+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected the incomplete data to be moved, got %v", err)
+	}
+	mt, _ := leecher.torrents.get(tf.InfoHash)
+	if info := mt.info(); info.Path != completed {
+		t.Errorf("Expected seeding from %s, got %s", completed, info.Path)
+	}
+	leecher.cacheMu.Lock()
+	cached := leecher.cache[tf.InfoHash.String()].Filepath
+	leecher.cacheMu.Unlock()
+	if cached != completed {
+		t.Errorf("Expected the cache to point to %s, got %s", completed, cached)
+	}
+}
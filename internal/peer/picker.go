@@ -0,0 +1,196 @@
+package peer
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// pieces downloaded first after the read cursor of a streamed torrent
+const defaultStreamWindow = 8
+
+// piecePriority is the order the missing pieces of a torrent are downloaded in
+type piecePriority struct {
+	// in index order instead of the order they are handed out
+	sequential bool
+	// the window pieces from the cursor on come first while streaming
+	streaming bool
+	cursor    int
+	window    int
+	// the windows of the open stream readers, by cursor, never modified once set
+	reads []pieceWindow
+}
+
+// pieceWindow is the window pieces from the cursor on
+type pieceWindow struct {
+	cursor int
+	window int
+}
+
+func (w pieceWindow) contains(index int) bool {
+	return index >= w.cursor && index < w.cursor+w.window
+}
+
+func (pr piecePriority) urgent(index int) bool {
+	if pr.streaming && (pieceWindow{pr.cursor, pr.window}).contains(index) {
+		return true
+	}
+	for _, w := range pr.reads {
+		if w.contains(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// before tells whether piece a is downloaded before piece b
+func (pr piecePriority) before(a, b int) bool {
+	if ua, ub := pr.urgent(a), pr.urgent(b); ua != ub {
+		return ua
+	} else if ua {
+		return a < b
+	}
+	return pr.sequential && a < b
+}
+
+// piecePicker hands out the missing pieces of a download to its connections
+type piecePicker struct {
+	mu sync.Mutex
+	// in the order they are handed out, the failed ones go last
+	pending  []*pieceInfo
+	priority piecePriority
+	// closed when pieces are put back or the priority changes
+	changed chan struct{}
+}
+
+func newPiecePicker(pending []*pieceInfo) *piecePicker {
+	return &piecePicker{
+		pending: pending,
+		changed: make(chan struct{}),
+	}
+}
+
+// pick removes the first piece to download among the ones the remote peer has, nil if none
+func (pp *piecePicker) pick(has func(index int) bool) *pieceInfo {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	best := -1
+	for i, pi := range pp.pending {
+		if !has(pi.index) {
+			continue
+		}
+		if best == -1 || pp.priority.before(pi.index, pp.pending[best].index) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	pi := pp.pending[best]
+	pp.pending = append(pp.pending[:best], pp.pending[best+1:]...)
+	return pi
+}
+
+// putBack returns a piece that failed to download
+func (pp *piecePicker) putBack(pi *pieceInfo) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.pending = append(pp.pending, pi)
+	pp.notifyLocked()
+}
+
+func (pp *piecePicker) setPriority(priority piecePriority) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.priority = priority
+	pp.notifyLocked()
+}
+
+// changes is closed on the next change, to wait for pieces to pick
+func (pp *piecePicker) changes() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.changed
+}
+
+func (pp *piecePicker) notifyLocked() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
+
+func (mt *managedTorrent) getPriority() piecePriority {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.priority
+}
+
+// updatePriority changes the priority of the torrent and of its running download
+func (mt *managedTorrent) updatePriority(fn func(pr *piecePriority)) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	fn(&mt.priority)
+	if mt.session != nil {
+		mt.session.picker.setPriority(mt.priority)
+	}
+}
+
+// setRead sets the window of an open stream reader, the pieces of every reader come first
+func (mt *managedTorrent) setRead(r *streamReader, w pieceWindow) {
+	mt.updatePriority(func(pr *piecePriority) {
+		if mt.readers == nil {
+			mt.readers = make(map[*streamReader]pieceWindow)
+		}
+		mt.readers[r] = w
+		pr.reads = mt.readWindowsLocked()
+	})
+}
+
+// removeRead forgets a closed stream reader, streaming stops with the last one
+func (mt *managedTorrent) removeRead(r *streamReader) {
+	mt.updatePriority(func(pr *piecePriority) {
+		delete(mt.readers, r)
+		pr.reads = mt.readWindowsLocked()
+	})
+}
+
+func (mt *managedTorrent) readWindowsLocked() []pieceWindow {
+	if len(mt.readers) == 0 {
+		return nil
+	}
+	reads := make([]pieceWindow, 0, len(mt.readers))
+	for _, w := range mt.readers {
+		reads = append(reads, w)
+	}
+	sort.Slice(reads, func(a, b int) bool { return reads[a].cursor < reads[b].cursor })
+	return reads
+}
+
+// SetSequential downloads the pieces of a torrent in order
+func (p *Peer) SetSequential(infoHash torrent.Sha1Hash, sequential bool) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.updatePriority(func(pr *piecePriority) { pr.sequential = sequential })
+	return p.saveCache()
+}
+
+// SetStreaming downloads first the window pieces from the one at the byte offset,
+// where the data is being read, 0 uses Config.StreamWindow and a negative offset stops streaming
+func (p *Peer) SetStreaming(infoHash torrent.Sha1Hash, offset int64, window int) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	if window <= 0 {
+		window = max(p.config.StreamWindow, 1)
+	}
+	cursor := int(min(offset, int64(mt.Length)-1) / int64(mt.PieceLength))
+	mt.updatePriority(func(pr *piecePriority) {
+		pr.streaming = offset >= 0
+		pr.cursor = cursor
+		pr.window = window
+	})
+	return nil
+}
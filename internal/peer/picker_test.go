@@ -0,0 +1,151 @@
+package peer
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func pickAll(pp *piecePicker, has func(int) bool) []int {
+	var picked []int
+	for pi := pp.pick(has); pi != nil; pi = pp.pick(has) {
+		picked = append(picked, pi.index)
+	}
+	return picked
+}
+
+func testPicker(order ...int) *piecePicker {
+	pending := make([]*pieceInfo, len(order))
+	for i, index := range order {
+		pending[i] = &pieceInfo{index: index}
+	}
+	return newPiecePicker(pending)
+}
+
+func expectPicked(t *testing.T, got []int, want ...int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestPiecePicker(t *testing.T) {
+	all := func(int) bool { return true }
+
+	// the order they are handed out in, failed pieces last
+	pp := testPicker(3, 0, 2, 1)
+	first := pp.pick(all)
+	pp.putBack(first)
+	expectPicked(t, pickAll(pp, all), 0, 2, 1, 3)
+
+	pp = testPicker(3, 0, 2, 1)
+	pp.setPriority(piecePriority{sequential: true})
+	expectPicked(t, pickAll(pp, all), 0, 1, 2, 3)
+
+	// only the pieces of the remote peer
+	pp = testPicker(0, 1, 2, 3)
+	pp.setPriority(piecePriority{sequential: true})
+	expectPicked(t, pickAll(pp, func(i int) bool { return i%2 == 1 }), 1, 3)
+
+	// the window after the cursor comes first, then the usual order
+	pp = testPicker(5, 4, 3, 2, 1, 0)
+	pp.setPriority(piecePriority{streaming: true, cursor: 2, window: 2})
+	expectPicked(t, pickAll(pp, all), 2, 3, 5, 4, 1, 0)
+
+	pp = testPicker(5, 4, 3, 2, 1, 0)
+	pp.setPriority(piecePriority{sequential: true, streaming: true, cursor: 3, window: 2})
+	expectPicked(t, pickAll(pp, all), 3, 4, 0, 1, 2, 5)
+
+	// waiting workers are woken up by changes
+	changed := pp.changes()
+	pp.putBack(&pieceInfo{index: 1})
+	select {
+	case <-changed:
+	default:
+		t.Errorf("Expected a change to be signalled")
+	}
+}
+
+func TestSetStreaming(t *testing.T) {
+	tf := testTorrent(make([]byte, 100), 10)
+	p := newTestPeer(t, filepath.Join(t.TempDir(), "cache.json"))
+	p.config.StreamWindow = 3
+	mt, err := p.torrents.add(tf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &DownloadSession{picker: testPicker(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)}
+	mt.activate(StateDownloading, nil, session)
+
+	if err := p.SetStreaming(tf.InfoHash, 45, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetSequential(tf.InfoHash, true); err != nil {
+		t.Fatal(err)
+	}
+	want := piecePriority{sequential: true, streaming: true, cursor: 4, window: 3}
+	if got := session.picker.priority; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if !mt.info().Sequential {
+		t.Errorf("Expected the torrent to be sequential")
+	}
+
+	// past the end the last piece is urgent
+	if err := p.SetStreaming(tf.InfoHash, 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.picker.priority; !got.urgent(9) || got.urgent(8) {
+		t.Errorf("Expected only the last piece to be urgent, got %+v", got)
+	}
+	if err := p.SetStreaming(tf.InfoHash, -1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if session.picker.priority.streaming {
+		t.Errorf("Expected streaming to stop")
+	}
+}
+
+func TestStreamReaders(t *testing.T) {
+	tf := testTorrent(make([]byte, 100), 10)
+	p := newTestPeer(t, filepath.Join(t.TempDir(), "cache.json"))
+	mt, err := p.torrents.add(tf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &DownloadSession{picker: testPicker(9, 8, 7, 6, 5, 4, 3, 2, 1, 0)}
+	mt.activate(StateDownloading, nil, session)
+
+	// the windows of every open reader come first
+	a, b := p.newStreamReader(context.Background(), mt, 0), p.newStreamReader(context.Background(), mt, 0)
+	a.cursor = 1
+	mt.setRead(a, pieceWindow{cursor: 1, window: 2})
+	b.cursor = 6
+	mt.setRead(b, pieceWindow{cursor: 6, window: 2})
+	all := func(int) bool { return true }
+	if pi := session.picker.pick(all); pi == nil || pi.index != 1 {
+		t.Fatalf("Expected the first piece of a window, got %+v", pi)
+	}
+	pr := mt.getPriority()
+	for i, want := range []bool{false, true, true, false, false, false, true, true, false, false} {
+		if pr.urgent(i) != want {
+			t.Errorf("Expected piece %d urgent %v, got %+v", i, want, pr)
+		}
+	}
+
+	// closing a reader keeps the windows of the others
+	a.Close()
+	if pr := mt.getPriority(); pr.urgent(2) || !pr.urgent(6) {
+		t.Errorf("Expected only the window of the open reader, got %+v", pr)
+	}
+	b.Close()
+	if pr := mt.getPriority(); len(pr.reads) != 0 {
+		t.Errorf("Expected streaming to stop with the last reader, got %+v", pr)
+	}
+}
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// The queues of downloads and seeds are limited separately
+type queueKind int
+
+const (
+	queueDownload queueKind = iota
+	queueSeed
+)
+
+// torrentQueue limits how many torrents are active at once, the others
+// wait in queue position order and are promoted when a slot is freed
+type torrentQueue struct {
+	mu     sync.Mutex
+	limits [2]int
+	// every waiting or active torrent, by queue position
+	order   []*managedTorrent
+	waiting map[*managedTorrent]queueKind
+	active  map[*managedTorrent]queueKind
+	// closed and replaced on every change
+	changed chan struct{}
+}
+
+// A limit of 0 means no limit
+func newTorrentQueue(maxDownloads, maxSeeds int) *torrentQueue {
+	return &torrentQueue{
+		limits:  [2]int{maxDownloads, maxSeeds},
+		waiting: make(map[*managedTorrent]queueKind),
+		active:  make(map[*managedTorrent]queueKind),
+		changed: make(chan struct{}),
+	}
+}
+
+func (q *torrentQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// notify wakes up the waiting torrents, e.g. when one is forced
+func (q *torrentQueue) notify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.notifyLocked()
+}
+
+// acquire waits for the torrent to get a slot, forced torrents get one right away
+func (q *torrentQueue) acquire(ctx context.Context, mt *managedTorrent, kind queueKind) error {
+	q.mu.Lock()
+	if !slices.Contains(q.order, mt) {
+		q.order = append(q.order, mt)
+	}
+	q.waiting[mt] = kind
+	for !q.eligibleLocked(mt, kind) {
+		mt.setState(StateQueued)
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		q.mu.Lock()
+	}
+	delete(q.waiting, mt)
+	q.active[mt] = kind
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *torrentQueue) eligibleLocked(mt *managedTorrent, kind queueKind) bool {
+	if mt.isForced() {
+		return true
+	}
+	if limit := q.limits[kind]; limit > 0 {
+		n := 0
+		for other, k := range q.active {
+			// forced torrents do not take a slot
+			if k == kind && !other.isForced() {
+				n++
+			}
+		}
+		if n >= limit {
+			return false
+		}
+	}
+	// the torrents ahead in the queue go first
+	for _, other := range q.order {
+		if other == mt {
+			break
+		}
+		if k, ok := q.waiting[other]; ok && k == kind {
+			return false
+		}
+	}
+	return true
+}
+
+// release frees the slot of the torrent and removes it from the queue
+func (q *torrentQueue) release(mt *managedTorrent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.waiting, mt)
+	delete(q.active, mt)
+	if i := slices.Index(q.order, mt); i >= 0 {
+		q.order = slices.Delete(q.order, i, i+1)
+	}
+	q.notifyLocked()
+}
+
+// position is the 0-based queue position of the torrent, -1 if not queued
+func (q *torrentQueue) position(mt *managedTorrent) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Index(q.order, mt)
+}
+
+// move puts the torrent at the queue position, clamped to the queue
+func (q *torrentQueue) move(mt *managedTorrent, pos int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.order, mt)
+	if i < 0 {
+		return false
+	}
+	q.order = slices.Delete(q.order, i, i+1)
+	pos = max(0, min(pos, len(q.order)))
+	q.order = slices.Insert(q.order, pos, mt)
+	q.notifyLocked()
+	return true
+}
+
+// SetQueuePosition moves a waiting or active torrent in the queue
+func (p *Peer) SetQueuePosition(infoHash torrent.Sha1Hash, pos int) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok || !p.queue.move(mt, pos) {
+		return ErrTorrentNotFound
+	}
+	return nil
+}
+
+// ForceStart starts a torrent regardless of the queue limits,
+// a paused torrent is resumed and the call returns when it stops
+func (p *Peer) ForceStart(ctx context.Context, infoHash torrent.Sha1Hash) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.setForced(true)
+	if state := mt.State(); state == StatePaused || state == StateError {
+		return p.Resume(ctx, infoHash)
+	}
+	p.queue.notify()
+	return nil
+}
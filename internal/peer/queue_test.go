@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func queuedTorrent(id byte) *managedTorrent {
+	return &managedTorrent{TorrentFile: &torrent.TorrentFile{InfoHash: torrent.Sha1Hash{id}}}
+}
+
+// acquireAsync starts waiting for a slot and returns once the torrent is active or queued
+func acquireAsync(t *testing.T, ctx context.Context, q *torrentQueue, mt *managedTorrent, kind queueKind) chan error {
+	t.Helper()
+	acquired := make(chan error, 1)
+	go func() { acquired <- q.acquire(ctx, mt, kind) }()
+	deadline := time.Now().Add(time.Second)
+	for q.position(mt) < 0 || (mt.State() != StateQueued && len(acquired) == 0) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the torrent to be queued or active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return acquired
+}
+
+func expectAcquired(t *testing.T, acquired chan error, want bool) {
+	t.Helper()
+	select {
+	case err := <-acquired:
+		if !want {
+			t.Errorf("Expected the torrent to wait in the queue")
+		} else if err != nil {
+			t.Errorf("Expected a slot, got %s", err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		if want {
+			t.Errorf("Expected the torrent to get a slot")
+		}
+	}
+}
+
+func TestQueuePromotion(t *testing.T) {
+	ctx := context.Background()
+	q := newTorrentQueue(1, 1)
+	a, b, c, seed := queuedTorrent(1), queuedTorrent(2), queuedTorrent(3), queuedTorrent(4)
+
+	expectAcquired(t, acquireAsync(t, ctx, q, a, queueDownload), true)
+	bAcquired := acquireAsync(t, ctx, q, b, queueDownload)
+	cAcquired := acquireAsync(t, ctx, q, c, queueDownload)
+	// seeds have their own limit
+	expectAcquired(t, acquireAsync(t, ctx, q, seed, queueSeed), true)
+	expectAcquired(t, bAcquired, false)
+
+	if pos := q.position(c); pos != 2 {
+		t.Errorf("Expected c at position 2, got %d", pos)
+	}
+	// c jumps ahead of b and is promoted once a is done
+	q.move(c, 0)
+	q.release(a)
+	expectAcquired(t, cAcquired, true)
+	expectAcquired(t, bAcquired, false)
+
+	q.release(c)
+	expectAcquired(t, bAcquired, true)
+}
+
+func TestQueueForceStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newTorrentQueue(1, 0)
+	a, b, c := queuedTorrent(1), queuedTorrent(2), queuedTorrent(3)
+
+	expectAcquired(t, acquireAsync(t, ctx, q, a, queueDownload), true)
+	bAcquired := acquireAsync(t, ctx, q, b, queueDownload)
+
+	b.setForced(true)
+	q.notify()
+	expectAcquired(t, bAcquired, true)
+
+	// a forced torrent does not take a slot from the others
+	q.release(a)
+	expectAcquired(t, acquireAsync(t, ctx, q, c, queueDownload), true)
+
+	// waiting stops with the context
+	d := queuedTorrent(4)
+	dAcquired := acquireAsync(t, ctx, q, d, queueDownload)
+	cancel()
+	if err := <-dAcquired; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// RateLimiter is a token bucket limiting the number of bytes per second
+// that pass through it. A limit of 0 means unlimited.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	tokens float64
+	last   time.Time
+	clock  Clock
+
+	// closed when the limiter is resumed, nil if not paused
+	resumed chan struct{}
+}
+
+func NewRateLimiter(limit int) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		tokens: float64(limit),
+		clock:  realClock{},
+	}
+}
+
+// Limit returns the current limit in bytes per second
+func (l *RateLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit changes the limit at runtime, waiters pick up the new limit
+// on their next call to WaitN
+func (l *RateLimiter) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.limit = limit
+	// the bucket holds at most one second worth of tokens
+	if l.tokens > float64(limit) {
+		l.tokens = float64(limit)
+	}
+}
+
+// SetPaused blocks every transfer through the limiter until it is resumed
+func (l *RateLimiter) SetPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if paused && l.resumed == nil {
+		l.resumed = make(chan struct{})
+	} else if !paused && l.resumed != nil {
+		close(l.resumed)
+		l.resumed = nil
+	}
+}
+
+// Paused reports whether the limiter is paused
+func (l *RateLimiter) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.resumed != nil
+}
+
+func (l *RateLimiter) refill() {
+	now := l.clock.Now()
+	if !l.last.IsZero() && l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n tokens from the bucket, the bucket may go into debt
+// and the caller has to wait for the returned duration before using them
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit <= 0 {
+		return 0
+	}
+
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed to pass or ctx is done
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		l.mu.Lock()
+		resumed := l.resumed
+		l.mu.Unlock()
+		if resumed == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+		}
+	}
+
+	wait := l.reserve(n)
+	if wait == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.clock.After(wait):
+		return nil
+	}
+}
+
+// The limiters of a single torrent
+type torrentLimiters struct {
+	upload   *RateLimiter
+	download *RateLimiter
+}
+
+// rateLimitedConn applies the upload limiters to writes and
+// the download limiters to reads
+type rateLimitedConn struct {
+	net.Conn
+	ctx      context.Context
+	upload   []*RateLimiter
+	download []*RateLimiter
+}
+
+// Bytes are read and written in chunks so that a single large message
+// does not consume a whole second worth of tokens at once
+const rateLimitChunk = MaxBlockSize
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if len(b) > rateLimitChunk {
+		b = b[:rateLimitChunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, l := range c.download {
+			if werr := l.WaitN(c.ctx, n); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := min(len(b)-written, rateLimitChunk)
+		for _, l := range c.upload {
+			if err := l.WaitN(c.ctx, chunk); err != nil {
+				return written, err
+			}
+		}
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (p *Peer) getTorrentLimiters(infoHash torrent.Sha1Hash) *torrentLimiters {
+	p.limitersMu.Lock()
+	defer p.limitersMu.Unlock()
+
+	tl, ok := p.torrentLimiters[infoHash.String()]
+	if !ok {
+		tl = &torrentLimiters{
+			upload:   NewRateLimiter(p.config.MaxTorrentUploadRate),
+			download: NewRateLimiter(p.config.MaxTorrentDownloadRate),
+		}
+		p.torrentLimiters[infoHash.String()] = tl
+	}
+	return tl
+}
+
+// removeTorrentLimiters forgets the limiters of a removed torrent
+func (p *Peer) removeTorrentLimiters(infoHash torrent.Sha1Hash) {
+	p.limitersMu.Lock()
+	defer p.limitersMu.Unlock()
+	delete(p.torrentLimiters, infoHash.String())
+}
+
+// limitConn wraps the connection of a torrent with the global
+// and the per torrent limiters
+func (p *Peer) limitConn(ctx context.Context, conn net.Conn, infoHash torrent.Sha1Hash) net.Conn {
+	tl := p.getTorrentLimiters(infoHash)
+	return &rateLimitedConn{
+		Conn:     conn,
+		ctx:      ctx,
+		upload:   []*RateLimiter{p.uploadLimiter, tl.upload},
+		download: []*RateLimiter{p.downloadLimiter, tl.download},
+	}
+}
+
+// SetRateLimits changes the global limits in bytes per second, 0 means unlimited.
+// If a bandwidth schedule is configured, these are the limits used outside of its rules
+func (p *Peer) SetRateLimits(upload, download int) {
+	p.limitersMu.Lock()
+	p.uploadRate = upload
+	p.downloadRate = download
+	p.limitersMu.Unlock()
+
+	if p.scheduler != nil {
+		p.scheduler.reapply()
+		return
+	}
+	p.uploadLimiter.SetLimit(upload)
+	p.downloadLimiter.SetLimit(download)
+}
+
+// SetTorrentRateLimits changes the limits of a single torrent in bytes per second, 0 means unlimited
+func (p *Peer) SetTorrentRateLimits(infoHash torrent.Sha1Hash, upload, download int) {
+	tl := p.getTorrentLimiters(infoHash)
+	tl.upload.SetLimit(upload)
+	tl.download.SetLimit(download)
+}
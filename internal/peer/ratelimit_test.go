@@ -0,0 +1,128 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	l := NewRateLimiter(1000)
+	l.clock = clock
+
+	if wait := l.reserve(1000); wait != 0 {
+		t.Errorf("Expected full bucket to not wait, got %s", wait)
+	}
+
+	if wait := l.reserve(500); wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of 500ms, got %s", wait)
+	}
+
+	// the debt is paid off after 500ms, then the bucket refills
+	clock.Advance(time.Second)
+	if wait := l.reserve(500); wait != 0 {
+		t.Errorf("Expected no wait after refill, got %s", wait)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := NewRateLimiter(0)
+	if wait := l.reserve(1 << 30); wait != 0 {
+		t.Errorf("Expected unlimited limiter to not wait, got %s", wait)
+	}
+
+	l.clock = newFakeClock(time.Unix(0, 0))
+	l.SetLimit(100)
+	if wait := l.reserve(100); wait != time.Second {
+		t.Errorf("Expected wait of 1s after setting limit, got %s", wait)
+	}
+}
+
+// transferTime advances the clock while the transfer waits on it and
+// returns how long the transfer took on the clock
+func transferTime(t *testing.T, clock *fakeClock, done <-chan error) time.Duration {
+	t.Helper()
+	start := clock.Now()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Failed to transfer: %s", err)
+			}
+			return clock.Now().Sub(start)
+		case <-time.After(time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the transfer")
+		}
+		clock.mu.Lock()
+		waiting := len(clock.waiters)
+		clock.mu.Unlock()
+		if waiting > 0 {
+			clock.Advance(100 * time.Millisecond)
+		}
+	}
+}
+
+func TestRateLimitedConn(t *testing.T) {
+	const limit = rateLimitChunk
+	clock := newFakeClock(time.Unix(0, 0))
+	upload, download := NewRateLimiter(limit), NewRateLimiter(limit)
+	upload.clock, download.clock = clock, clock
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := &rateLimitedConn{
+		Conn:     a,
+		ctx:      context.Background(),
+		upload:   []*RateLimiter{upload},
+		download: []*RateLimiter{download},
+	}
+
+	// the first second worth of bytes is in the bucket, the rest
+	// goes at the limit
+	data := bytes.Repeat([]byte{1}, 5*limit)
+	received := make(chan []byte, 1)
+	go func() {
+		buf, _ := io.ReadAll(io.LimitReader(b, int64(len(data))))
+		received <- buf
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		done <- err
+	}()
+	if elapsed := transferTime(t, clock, done); elapsed != 4*time.Second {
+		t.Errorf("Expected writing %d bytes at %d B/s to take 4s, got %s", len(data), limit, elapsed)
+	}
+	if buf := <-received; !bytes.Equal(buf, data) {
+		t.Errorf("Expected the written bytes to be received, got %d bytes", len(buf))
+	}
+
+	data = bytes.Repeat([]byte{2}, 3*limit)
+	go b.Write(data)
+	var read []byte
+	go func() {
+		buf := make([]byte, 2*limit)
+		for len(read) < len(data) {
+			n, err := conn.Read(buf)
+			read = append(read, buf[:n]...)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if elapsed := transferTime(t, clock, done); elapsed != 2*time.Second {
+		t.Errorf("Expected reading %d bytes at %d B/s to take 2s, got %s", len(data), limit, elapsed)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Expected the sent bytes to be read, got %d bytes", len(read))
+	}
+}
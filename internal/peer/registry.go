@@ -0,0 +1,365 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+var ErrTorrentExists = errors.New("torrent already added")
+
+type TorrentState int
+
+const (
+	// the data on disk is being opened and verified
+	StateChecking TorrentState = iota
+	// waiting for a slot, see Config.MaxActiveDownloads
+	StateQueued
+	StateDownloading
+	StateSeeding
+	StatePaused
+	// stopped on an error, see TorrentInfo.Error
+	StateError
+)
+
+var stateNames = [...]string{"checking", "queued", "downloading", "seeding", "paused", "error"}
+
+func (s TorrentState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// Bytes transferred for a torrent, over all its connections and sessions
+type torrentCounters struct {
+	// blocks of pieces
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	// everything else on the wire, handshakes and protocol messages
+	uploadedOverhead   atomic.Int64
+	downloadedOverhead atomic.Int64
+}
+
+// A torrent added to the peer and its lifecycle
+type managedTorrent struct {
+	*torrent.TorrentFile
+	// the download directory, or the data when seeding
+	path string
+
+	mu    sync.Mutex
+	state TorrentState
+	err   error
+	// whether the torrent is seeded instead of downloaded
+	seeding   bool
+	superSeed bool
+	// set once downloaded, the data is complete
+	downloaded bool
+	// where the data is stored, once known
+	dataPath string
+	// stops the running torrent, nil when it is not running
+	cancel context.CancelFunc
+	done   chan struct{}
+	// set when the torrent was stopped by the user
+	stopped bool
+	// started regardless of the queue
+	forced bool
+	// restored from the cache on start, set before Run
+	restored bool
+
+	counters torrentCounters
+	// time spent seeding before the current session
+	seedTime time.Duration
+	// zero unless seeding
+	seedingSince time.Time
+	// 0 to use the global limits, negative for no limit
+	ratioLimit    float64
+	seedTimeLimit time.Duration
+	// the order of the pieces when downloading
+	priority piecePriority
+	// the windows of the open stream readers
+	readers map[*streamReader]pieceWindow
+	// held while MoveStorage moves the data
+	moveMu sync.Mutex
+	// nil unless the torrent is active
+	swarm *swarm
+	// nil unless downloading
+	session *DownloadSession
+}
+
+// Snapshot of a torrent for the user
+type TorrentInfo struct {
+	InfoHash torrent.Sha1Hash
+	Name     string
+	Path     string
+	State    TorrentState
+	Error    error
+	// -1 unless waiting or active
+	QueuePosition int
+	Forced        bool
+	Sequential    bool
+	// payload bytes
+	Uploaded   int64
+	Downloaded int64
+	// protocol bytes
+	UploadedOverhead   int64
+	DownloadedOverhead int64
+	Ratio              float64
+	SeedTime           time.Duration
+}
+
+func (mt *managedTorrent) info() TorrentInfo {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return TorrentInfo{
+		InfoHash:           mt.InfoHash,
+		Name:               mt.Name,
+		Path:               mt.path,
+		State:              mt.state,
+		Error:              mt.err,
+		Forced:             mt.forced,
+		Sequential:         mt.priority.sequential,
+		Uploaded:           mt.counters.uploaded.Load(),
+		Downloaded:         mt.counters.downloaded.Load(),
+		UploadedOverhead:   mt.counters.uploadedOverhead.Load(),
+		DownloadedOverhead: mt.counters.downloadedOverhead.Load(),
+		Ratio:              mt.ratio(),
+		SeedTime:           mt.seedTimeLocked(time.Now()),
+	}
+}
+
+// ratio is the uploaded bytes over the downloaded ones,
+// or over the size of the torrent when it was never downloaded
+func (mt *managedTorrent) ratio() float64 {
+	downloaded := mt.counters.downloaded.Load()
+	if downloaded == 0 {
+		downloaded = int64(mt.Length)
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(mt.counters.uploaded.Load()) / float64(downloaded)
+}
+
+func (mt *managedTorrent) seedTimeLocked(now time.Time) time.Duration {
+	if mt.seedingSince.IsZero() {
+		return mt.seedTime
+	}
+	return mt.seedTime + now.Sub(mt.seedingSince)
+}
+
+// startSeedClock and stopSeedClock account the time spent seeding
+func (mt *managedTorrent) startSeedClock(now time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.seedingSince = now
+}
+
+func (mt *managedTorrent) stopSeedClock(now time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.seedTime = mt.seedTimeLocked(now)
+	mt.seedingSince = time.Time{}
+}
+
+func (mt *managedTorrent) State() TorrentState {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.state
+}
+
+func (mt *managedTorrent) setState(state TorrentState) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.state = state
+	mt.err = nil
+}
+
+// fail stops the torrent on an error
+func (mt *managedTorrent) fail(err error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.state = StateError
+	mt.err = err
+	mt.swarm = nil
+	mt.session = nil
+}
+
+// activate sets the connections of the torrent and its new state
+func (mt *managedTorrent) activate(state TorrentState, sw *swarm, session *DownloadSession) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.state = state
+	mt.err = nil
+	mt.swarm = sw
+	mt.session = session
+	if session != nil {
+		session.picker.setPriority(mt.priority)
+	}
+}
+
+// seed switches the torrent to seeding the data at the path
+func (mt *managedTorrent) seed(path string, superSeed bool) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.seeding = true
+	mt.superSeed = superSeed
+	mt.path = path
+	mt.dataPath = path
+}
+
+func (mt *managedTorrent) setDataPath(path string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.dataPath = path
+}
+
+// start marks the torrent as running, it fails if it already is
+func (mt *managedTorrent) start(cancel context.CancelFunc) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.cancel != nil {
+		return false
+	}
+	mt.cancel = cancel
+	mt.done = make(chan struct{})
+	mt.stopped = false
+	mt.state = StateChecking
+	mt.err = nil
+	return true
+}
+
+// finish marks the torrent as not running anymore
+func (mt *managedTorrent) finish() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.cancel()
+	close(mt.done)
+	mt.cancel = nil
+	mt.done = nil
+	mt.swarm = nil
+	mt.session = nil
+}
+
+// stop cancels the running torrent and waits for it to finish
+func (mt *managedTorrent) stop() {
+	mt.mu.Lock()
+	cancel, done := mt.cancel, mt.done
+	mt.stopped = true
+	mt.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (mt *managedTorrent) setForced(forced bool) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.forced = forced
+}
+
+func (mt *managedTorrent) isForced() bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.forced
+}
+
+func (mt *managedTorrent) isStopped() bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.stopped
+}
+
+func (mt *managedTorrent) getSwarm() *swarm {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.swarm
+}
+
+func (mt *managedTorrent) getSession() *DownloadSession {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.session
+}
+
+// registry keeps every torrent of the peer, it is accessed from
+// the event goroutines, the accept loop and on close
+type registry struct {
+	mu       sync.RWMutex
+	torrents map[torrent.Sha1Hash]*managedTorrent
+}
+
+func newRegistry() *registry {
+	return &registry{
+		torrents: make(map[torrent.Sha1Hash]*managedTorrent),
+	}
+}
+
+// add registers a torrent in the checking state
+func (r *registry) add(tf *torrent.TorrentFile, path string) (*managedTorrent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.torrents[tf.InfoHash]; ok {
+		return nil, ErrTorrentExists
+	}
+	mt := &managedTorrent{
+		TorrentFile: tf,
+		path:        path,
+		state:       StateChecking,
+	}
+	r.torrents[tf.InfoHash] = mt
+	return mt, nil
+}
+
+func (r *registry) get(infoHash torrent.Sha1Hash) (*managedTorrent, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mt, ok := r.torrents[infoHash]
+	return mt, ok
+}
+
+// remove unregisters the torrent if it is still the given one
+func (r *registry) remove(mt *managedTorrent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.torrents[mt.InfoHash] == mt {
+		delete(r.torrents, mt.InfoHash)
+	}
+}
+
+func (r *registry) list() []*managedTorrent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	torrents := make([]*managedTorrent, 0, len(r.torrents))
+	for _, mt := range r.torrents {
+		torrents = append(torrents, mt)
+	}
+	return torrents
+}
+
+// swarm returns the connections of an active torrent, nil if there is none
+func (r *registry) swarm(infoHash torrent.Sha1Hash) *swarm {
+	mt, ok := r.get(infoHash)
+	if !ok {
+		return nil
+	}
+	return mt.getSwarm()
+}
+
+// Torrents lists the torrents of the peer
+func (p *Peer) Torrents() []TorrentInfo {
+	torrents := p.torrents.list()
+	infos := make([]TorrentInfo, 0, len(torrents))
+	for _, mt := range torrents {
+		info := mt.info()
+		info.QueuePosition = p.queue.position(mt)
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,129 @@
+package peer
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestRegistryAddTwice(t *testing.T) {
+	r := newRegistry()
+	tf := testTorrent([]byte("0123456789"), 4)
+
+	mt, err := r.add(tf, "a")
+	if err != nil {
+		t.Fatalf("Failed to add torrent: %s", err)
+	}
+	if mt.State() != StateChecking {
+		t.Errorf("Expected state checking, got %s", mt.State())
+	}
+	if _, err := r.add(tf, "b"); err != ErrTorrentExists {
+		t.Errorf("Expected ErrTorrentExists, got %v", err)
+	}
+
+	// removing a stale entry keeps the new one
+	r.remove(mt)
+	mt2, err := r.add(tf, "b")
+	if err != nil {
+		t.Fatalf("Failed to add torrent again: %s", err)
+	}
+	r.remove(mt)
+	if got, ok := r.get(tf.InfoHash); !ok || got != mt2 {
+		t.Errorf("Expected the new entry to be kept")
+	}
+}
+
+func TestRegistryStates(t *testing.T) {
+	r := newRegistry()
+	tf := testTorrent([]byte("0123456789"), 4)
+	mt, _ := r.add(tf, "a")
+
+	if sw := r.swarm(tf.InfoHash); sw != nil {
+		t.Errorf("Expected no swarm while checking")
+	}
+
+	sw := testSwarm(t, tf, 1, nil)
+	mt.activate(StateDownloading, sw, nil)
+	if got := r.swarm(tf.InfoHash); got != sw {
+		t.Errorf("Expected the swarm of the downloading torrent")
+	}
+
+	mt.fail(ErrIntegrity)
+	info := mt.info()
+	if info.State != StateError || info.Error != ErrIntegrity {
+		t.Errorf("Expected error state with ErrIntegrity, got %s %v", info.State, info.Error)
+	}
+	if r.swarm(tf.InfoHash) != nil {
+		t.Errorf("Expected no swarm after an error")
+	}
+
+	mt.setState(StatePaused)
+	if info := mt.info(); info.State != StatePaused || info.Error != nil {
+		t.Errorf("Expected paused state without error, got %s %v", info.State, info.Error)
+	}
+	if TorrentState(42).String() != "unknown" {
+		t.Errorf("Expected unknown state name")
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := newRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tf := testTorrent([]byte{byte(i)}, 1)
+			tf.InfoHash = torrent.Sha1Hash{byte(i)}
+			mt, err := r.add(tf, "")
+			if err != nil {
+				t.Errorf("Failed to add torrent %d: %s", i, err)
+				return
+			}
+			mt.setState(StateDownloading)
+			r.swarm(tf.InfoHash)
+			for _, other := range r.list() {
+				other.info()
+			}
+			if i%2 == 0 {
+				r.remove(mt)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(r.list()); n != 8 {
+		t.Errorf("Expected 8 torrents, got %d", n)
+	}
+}
+
+func TestRespondHandshake(t *testing.T) {
+	tf := testTorrent([]byte("0123456789"), 4)
+	tf.InfoHash = torrent.Sha1Hash{0xab}
+	p := &Peer{torrents: newRegistry(), PeerID: [20]byte{1}}
+	mt, _ := p.torrents.add(tf, "")
+	sw := testSwarm(t, tf, 1, []byte("0123456789"))
+	mt.activate(StateSeeding, sw, nil)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		b.Write(connection.NewHandshake(tf.InfoHash, [20]byte{2}).Serialize())
+		connection.ReadHandshake(b)
+	}()
+
+	got, req, err := p.respondHandshake(a)
+	if err != nil {
+		t.Fatalf("Failed to respond to handshake: %s", err)
+	}
+	if got != sw {
+		t.Errorf("Expected the swarm of the torrent")
+	}
+	if req.PeerID != [20]byte{2} {
+		t.Errorf("Expected the remote peer ID, got %x", req.PeerID)
+	}
+}
@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Clock abstracts time so that time driven components can be tested
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ScheduleRule overrides the global bandwidth limits on the given days
+// from StartHour (inclusive) to EndHour (exclusive), in local time.
+// If EndHour is less than or equal to StartHour, the range wraps past midnight
+// into the next day, e.g. 22 to 6
+type ScheduleRule struct {
+	// Empty means every day
+	Days      []time.Weekday
+	StartHour int
+	EndHour   int
+
+	// Limits in bytes per second, 0 means unlimited
+	MaxUploadRate   int
+	MaxDownloadRate int
+	// Stop all transfers while the rule is active
+	Pause bool
+}
+
+func (r *ScheduleRule) validate() error {
+	if r.StartHour < 0 || r.StartHour > 23 {
+		return fmt.Errorf("Invalid schedule start hour %d", r.StartHour)
+	}
+	if r.EndHour < 0 || r.EndHour > 24 {
+		return fmt.Errorf("Invalid schedule end hour %d", r.EndHour)
+	}
+	for _, d := range r.Days {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("Invalid schedule weekday %d", d)
+		}
+	}
+	return nil
+}
+
+func (r *ScheduleRule) onDay(d time.Weekday) bool {
+	return len(r.Days) == 0 || slices.Contains(r.Days, d)
+}
+
+// Matches reports whether the rule is active at t
+func (r *ScheduleRule) Matches(t time.Time) bool {
+	hour := t.Hour()
+	if r.StartHour < r.EndHour {
+		return r.onDay(t.Weekday()) && hour >= r.StartHour && hour < r.EndHour
+	}
+
+	// wraps past midnight, the early hours belong to the rule of the previous day
+	yesterday := (t.Weekday() + 6) % 7
+	return (r.onDay(t.Weekday()) && hour >= r.StartHour) ||
+		(r.onDay(yesterday) && hour < r.EndHour)
+}
+
+// scheduler applies the first matching rule of the schedule
+// every time an hour boundary is crossed
+type scheduler struct {
+	rules   []ScheduleRule
+	clock   Clock
+	apply   func(rule *ScheduleRule)
+	refresh chan struct{}
+}
+
+func newScheduler(rules []ScheduleRule, clock Clock, apply func(rule *ScheduleRule)) (*scheduler, error) {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &scheduler{
+		rules:   rules,
+		clock:   clock,
+		apply:   apply,
+		refresh: make(chan struct{}, 1),
+	}, nil
+}
+
+// activeRule returns the first rule matching t, nil if none
+func (s *scheduler) activeRule(t time.Time) *ScheduleRule {
+	for i := range s.rules {
+		if s.rules[i].Matches(t) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// Reapply the active rule without waiting for the next hour boundary
+func (s *scheduler) reapply() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// untilNextHour is the time left until the next hour of the local time of t,
+// truncating would use absolute time and miss zones with a fractional offset
+func untilNextHour(t time.Time) time.Duration {
+	next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	return next.Sub(t)
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	for {
+		now := s.clock.Now()
+		s.apply(s.activeRule(now))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.refresh:
+		case <-s.clock.After(untilNextHour(now)):
+		}
+	}
+}
+
+// applySchedule sets the global limiters according to the active rule,
+// falling back to the configured limits if no rule is active
+func (p *Peer) applySchedule(rule *ScheduleRule) {
+	p.limitersMu.Lock()
+	upload, download := p.uploadRate, p.downloadRate
+	p.limitersMu.Unlock()
+
+	paused := false
+	if rule != nil {
+		upload, download, paused = rule.MaxUploadRate, rule.MaxDownloadRate, rule.Pause
+	}
+
+	p.uploadLimiter.SetLimit(upload)
+	p.downloadLimiter.SetLimit(download)
+	p.uploadLimiter.SetPaused(paused)
+	p.downloadLimiter.SetPaused(paused)
+}
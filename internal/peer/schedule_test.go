@@ -0,0 +1,241 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// fakeClock only moves when advanced by the test
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.at.After(c.now) {
+			w.ch <- c.now
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	c.waiters = remaining
+}
+
+// waitForWaiters blocks until n goroutines are waiting on the clock
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		count := len(c.waiters)
+		c.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d clock waiters", n)
+}
+
+// 2024-06-03 is a Monday
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, time.June, 3+day, hour, minute, 0, 0, time.Local)
+}
+
+var workdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+func TestScheduleRuleMatches(t *testing.T) {
+	workHours := ScheduleRule{Days: workdays, StartHour: 9, EndHour: 17}
+	overnight := ScheduleRule{Days: []time.Weekday{time.Friday}, StartHour: 22, EndHour: 6}
+	everyDay := ScheduleRule{StartHour: 12, EndHour: 13}
+
+	tests := []struct {
+		name string
+		rule ScheduleRule
+		t    time.Time
+		want bool
+	}{
+		{"work hours start", workHours, at(0, 9, 0), true},
+		{"work hours before start", workHours, at(0, 8, 59), false},
+		{"work hours end is exclusive", workHours, at(0, 17, 0), false},
+		{"work hours on saturday", workHours, at(5, 10, 0), false},
+		{"overnight evening", overnight, at(4, 23, 0), true},
+		{"overnight after midnight", overnight, at(5, 5, 59), true},
+		{"overnight morning end", overnight, at(5, 6, 0), false},
+		{"overnight on other evening", overnight, at(5, 23, 0), false},
+		{"overnight early hours of rule day", overnight, at(4, 3, 0), false},
+		{"every day", everyDay, at(6, 12, 30), true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.Matches(tt.t); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNewSchedulerInvalidRule(t *testing.T) {
+	rules := [][]ScheduleRule{
+		{{StartHour: 24, EndHour: 1}},
+		{{StartHour: 1, EndHour: 25}},
+		{{Days: []time.Weekday{7}, StartHour: 1, EndHour: 2}},
+	}
+	for _, r := range rules {
+		if _, err := newScheduler(r, newFakeClock(at(0, 0, 0)), func(*ScheduleRule) {}); err == nil {
+			t.Errorf("Expected error for rule %+v", r[0])
+		}
+	}
+}
+
+func TestSchedulerFirstRuleWins(t *testing.T) {
+	rules := []ScheduleRule{
+		{StartHour: 12, EndHour: 13, Pause: true},
+		{StartHour: 9, EndHour: 17, MaxUploadRate: 100},
+	}
+	s, err := newScheduler(rules, newFakeClock(at(0, 0, 0)), func(*ScheduleRule) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := s.activeRule(at(0, 12, 30)); rule == nil || !rule.Pause {
+		t.Errorf("Expected pause rule at lunch, got %+v", rule)
+	}
+	if rule := s.activeRule(at(0, 10, 0)); rule == nil || rule.MaxUploadRate != 100 {
+		t.Errorf("Expected throttle rule in the morning, got %+v", rule)
+	}
+	if rule := s.activeRule(at(0, 20, 0)); rule != nil {
+		t.Errorf("Expected no rule in the evening, got %+v", rule)
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	clock := newFakeClock(at(0, 8, 30))
+	applied := make(chan *ScheduleRule, 1)
+	rules := []ScheduleRule{{Days: workdays, StartHour: 9, EndHour: 17, MaxUploadRate: 1024}}
+
+	s, err := newScheduler(rules, clock, func(r *ScheduleRule) { applied <- r })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	expect := func(throttled bool) {
+		t.Helper()
+		select {
+		case r := <-applied:
+			if throttled != (r != nil) {
+				t.Fatalf("At %s expected throttled = %v, got rule %+v", clock.Now(), throttled, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("At %s rule was not applied", clock.Now())
+		}
+	}
+
+	// full speed before work hours
+	expect(false)
+
+	// the scheduler wakes up on the hour
+	clock.waitForWaiters(t, 1)
+	clock.Advance(30 * time.Minute)
+	expect(true)
+
+	for range 8 {
+		clock.waitForWaiters(t, 1)
+		clock.Advance(time.Hour)
+		if clock.Now().Hour() < 17 {
+			expect(true)
+		}
+	}
+	// full speed again at 17:00
+	expect(false)
+
+	// reapplying does not wait for the clock
+	s.reapply()
+	expect(false)
+}
+
+func TestUntilNextHour(t *testing.T) {
+	// the hours of a zone with a fractional offset do not start on absolute hours
+	ist := time.FixedZone("IST", 5*3600+1800)
+	cases := []struct {
+		t    time.Time
+		want time.Duration
+	}{
+		{time.Date(2024, 3, 4, 10, 20, 0, 0, time.UTC), 40 * time.Minute},
+		{time.Date(2024, 3, 4, 10, 20, 0, 0, ist), 40 * time.Minute},
+		{time.Date(2024, 3, 4, 23, 59, 30, 0, ist), 30 * time.Second},
+		{time.Date(2024, 3, 4, 10, 0, 0, 0, ist), time.Hour},
+	}
+	for _, c := range cases {
+		if got := untilNextHour(c.t); got != c.want {
+			t.Errorf("Expected %s until the next hour of %s, got %s", c.want, c.t, got)
+		}
+	}
+}
+
+func TestPeerApplySchedule(t *testing.T) {
+	p := &Peer{
+		uploadRate:      10,
+		downloadRate:    20,
+		uploadLimiter:   NewRateLimiter(10),
+		downloadLimiter: NewRateLimiter(20),
+	}
+
+	p.applySchedule(&ScheduleRule{MaxUploadRate: 1, MaxDownloadRate: 2})
+	if p.uploadLimiter.Limit() != 1 || p.downloadLimiter.Limit() != 2 {
+		t.Errorf("Expected limits 1/2, got %d/%d", p.uploadLimiter.Limit(), p.downloadLimiter.Limit())
+	}
+
+	p.applySchedule(&ScheduleRule{Pause: true})
+	if !p.uploadLimiter.Paused() || !p.downloadLimiter.Paused() {
+		t.Errorf("Expected limiters to be paused")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.uploadLimiter.WaitN(ctx, 1); err == nil {
+		t.Errorf("Expected paused limiter to block")
+	}
+
+	p.applySchedule(nil)
+	if p.uploadLimiter.Paused() || p.downloadLimiter.Paused() {
+		t.Errorf("Expected limiters to be resumed")
+	}
+	if p.uploadLimiter.Limit() != 10 || p.downloadLimiter.Limit() != 20 {
+		t.Errorf("Expected configured limits 10/20, got %d/%d", p.uploadLimiter.Limit(), p.downloadLimiter.Limit())
+	}
+}
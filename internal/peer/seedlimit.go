@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// What happens to a torrent that reached its seed limits
+const (
+	SeedLimitStop   = "stop"
+	SeedLimitRemove = "remove"
+)
+
+// how often the seed limits are checked while seeding
+const seedLimitInterval = 30 * time.Second
+
+var errSeedLimitReached = errors.New("seed limit reached")
+
+// seedLimits returns the limits of a torrent, 0 for no limit
+func (p *Peer) seedLimits(mt *managedTorrent) (float64, time.Duration) {
+	mt.mu.Lock()
+	ratio, seedTime := mt.ratioLimit, mt.seedTimeLimit
+	mt.mu.Unlock()
+
+	if ratio == 0 {
+		ratio = p.config.SeedRatioLimit
+	}
+	if seedTime == 0 {
+		seedTime = time.Duration(p.config.SeedTimeLimit) * time.Minute
+	}
+	return max(ratio, 0), max(seedTime, 0)
+}
+
+func (p *Peer) seedLimitExceeded(mt *managedTorrent) bool {
+	ratioLimit, seedTimeLimit := p.seedLimits(mt)
+	if ratioLimit > 0 && mt.ratio() >= ratioLimit {
+		return true
+	}
+	if seedTimeLimit > 0 {
+		mt.mu.Lock()
+		seedTime := mt.seedTimeLocked(time.Now())
+		mt.mu.Unlock()
+		if seedTime >= seedTimeLimit {
+			return true
+		}
+	}
+	return false
+}
+
+// finishSeeding stops or removes a torrent that reached its seed limits
+func (p *Peer) finishSeeding(mt *managedTorrent) error {
+	logger.Info("Seed limit reached", "Info hash", mt.InfoHash.String(), "ratio", mt.ratio())
+	if p.config.SeedLimitAction == SeedLimitRemove {
+		p.torrents.remove(mt)
+		p.removeTorrentLimiters(mt.InfoHash)
+		p.forgetCached(mt.InfoHash)
+		return p.saveCache()
+	}
+	mt.setState(StatePaused)
+	p.setCachedPaused(mt, true)
+	return p.saveCache()
+}
+
+// SetSeedLimits overrides the global seed limits of a torrent,
+// 0 uses the global limit and a negative value means no limit
+func (p *Peer) SetSeedLimits(infoHash torrent.Sha1Hash, ratio float64, seedTime time.Duration) error {
+	mt, ok := p.torrents.get(infoHash)
+	if !ok {
+		return ErrTorrentNotFound
+	}
+	mt.mu.Lock()
+	mt.ratioLimit = ratio
+	mt.seedTimeLimit = seedTime
+	mt.mu.Unlock()
+	return p.saveCache()
+}
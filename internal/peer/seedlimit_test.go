@@ -0,0 +1,119 @@
+package peer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func seedLimitTorrent(t *testing.T) (*torrent.TorrentFile, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = newFakeTracker(t).URL
+	tf.InfoHash = torrent.Sha1Hash{0xcd}
+	return tf, path, filepath.Join(dir, "cache.json")
+}
+
+func TestSeedRatioLimit(t *testing.T) {
+	tf, path, cachePath := seedLimitTorrent(t)
+	p := newTestPeer(t, cachePath)
+	p.config.SeedRatioLimit = 2
+
+	// counters of a previous run
+	p.cache[tf.InfoHash.String()] = &CachedFile{
+		Filepath: path,
+		InfoHash: tf.InfoHash.String(),
+		Seeding:  true,
+		Uploaded: 3 * int64(tf.Length),
+	}
+	if err := p.seedTorrent(context.Background(), tf, path, false); err != nil {
+		t.Fatalf("Failed to seed: %s", err)
+	}
+	info := p.Torrents()[0]
+	if info.State != StatePaused {
+		t.Errorf("Expected the torrent to be paused, got %s", info.State)
+	}
+	if info.Ratio != 3 {
+		t.Errorf("Expected ratio 3, got %f", info.Ratio)
+	}
+
+	// the counters and the paused state persist
+	cache, err := LoadCache(cachePath)
+	if err != nil {
+		t.Fatalf("Failed to load cache: %s", err)
+	}
+	cached := cache[tf.InfoHash.String()]
+	if !cached.Paused || cached.Uploaded != 3*int64(tf.Length) {
+		t.Errorf("Expected a paused entry with the uploaded bytes, got %+v", cached)
+	}
+
+	// raising the limit of the torrent lets it seed again
+	if err := p.SetSeedLimits(tf.InfoHash, 5, 0); err != nil {
+		t.Fatalf("Failed to set limits: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resumed := make(chan error, 1)
+	go func() { resumed <- p.Resume(ctx, tf.InfoHash) }()
+	waitForState(t, p, tf.InfoHash, StateSeeding)
+	cancel()
+	<-resumed
+}
+
+func TestSeedTimeLimitRemove(t *testing.T) {
+	tf, path, cachePath := seedLimitTorrent(t)
+	p := newTestPeer(t, cachePath)
+	p.config.SeedTimeLimit = 60
+	p.config.SeedLimitAction = SeedLimitRemove
+
+	p.cache[tf.InfoHash.String()] = &CachedFile{
+		Filepath: path,
+		InfoHash: tf.InfoHash.String(),
+		Seeding:  true,
+		SeedTime: 2 * time.Hour,
+	}
+	if err := p.seedTorrent(context.Background(), tf, path, false); err != nil {
+		t.Fatalf("Failed to seed: %s", err)
+	}
+	if n := len(p.Torrents()); n != 0 {
+		t.Errorf("Expected the torrent to be removed, got %d torrents", n)
+	}
+	if _, ok := p.cache[tf.InfoHash.String()]; ok {
+		t.Errorf("Expected the cache entry to be removed")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the data to be kept, got %s", err)
+	}
+}
+
+func TestSeedLimitsOverride(t *testing.T) {
+	p := &Peer{config: &Config{SeedRatioLimit: 2, SeedTimeLimit: 10}}
+	mt := &managedTorrent{TorrentFile: &torrent.TorrentFile{Length: 100}}
+
+	if ratio, seedTime := p.seedLimits(mt); ratio != 2 || seedTime != 10*time.Minute {
+		t.Errorf("Expected the global limits, got %f %s", ratio, seedTime)
+	}
+	mt.ratioLimit, mt.seedTimeLimit = -1, time.Hour
+	if ratio, seedTime := p.seedLimits(mt); ratio != 0 || seedTime != time.Hour {
+		t.Errorf("Expected no ratio limit and 1h, got %f %s", ratio, seedTime)
+	}
+
+	mt.ratioLimit = 0.5
+	mt.counters.uploaded.Store(40)
+	if p.seedLimitExceeded(mt) {
+		t.Errorf("Expected ratio 0.4 to be below the limit")
+	}
+	mt.counters.uploaded.Store(60)
+	if !p.seedLimitExceeded(mt) {
+		t.Errorf("Expected ratio 0.6 to exceed the limit")
+	}
+}
@@ -0,0 +1,203 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+type restoredTorrent struct {
+	mt *managedTorrent
+	// the data changed since the cache was saved
+	check bool
+}
+
+// restoreSession adds the torrents saved in the cache,
+// the ones that were not paused are started by Run
+func (p *Peer) restoreSession() {
+	p.cacheMu.Lock()
+	cached := make([]*CachedFile, 0, len(p.cache))
+	for _, cache := range p.cache {
+		cached = append(cached, cache)
+	}
+	p.cacheMu.Unlock()
+
+	for _, cache := range cached {
+		// saved before the metainfo was cached
+		if len(cache.Metainfo) == 0 {
+			continue
+		}
+		mt, err := p.restoreCached(cache)
+		if err != nil {
+			logger.Error("Failed to restore torrent", "infohash", cache.InfoHash, "error", err)
+			continue
+		}
+		if p.restoreTorrent(mt) {
+			mt.setState(StatePaused)
+			continue
+		}
+		p.restored = append(p.restored, restoredTorrent{mt: mt, check: cache.dataChanged()})
+	}
+}
+
+// addedRestored tells whether adding the torrent failed only because it was
+// restored from the cache on start, e.g. given again on the command line
+func (p *Peer) addedRestored(tf *torrent.TorrentFile, err error) bool {
+	if !errors.Is(err, ErrTorrentExists) {
+		return false
+	}
+	mt, ok := p.torrents.get(tf.InfoHash)
+	if !ok {
+		return false
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.restored
+}
+
+func (p *Peer) restoreCached(cache *CachedFile) (*managedTorrent, error) {
+	tf, err := torrent.OpenFromReader(bytes.NewReader(cache.Metainfo))
+	if err != nil {
+		return nil, err
+	}
+	// the original info dictionary may have had keys that are not kept
+	infoHash, err := ParseInfoHash(cache.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	tf.InfoHash = infoHash
+
+	if cache.Seeding {
+		mt, err := p.torrents.add(tf, cache.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		mt.seed(cache.Filepath, cache.SuperSeed)
+		mt.restored = true
+		return mt, nil
+	}
+	mt, err := p.torrents.add(tf, cache.DownloadPath)
+	if err != nil {
+		return nil, err
+	}
+	mt.setDataPath(cache.Filepath)
+	mt.restored = true
+	return mt, nil
+}
+
+// startRestored runs a restored torrent, checking its data first
+// if it changed or if configured
+func (p *Peer) startRestored(ctx context.Context, mt *managedTorrent, check bool) {
+	if check || p.config.VerifyOnRestore {
+		if err := p.checkTorrent(mt); err != nil {
+			logger.Error("Failed to check torrent", "infohash", mt.InfoHash.String(), "error", err)
+			mt.fail(err)
+			return
+		}
+	}
+	if err := p.runTorrent(ctx, mt); err != nil {
+		logger.Error("Failed to run restored torrent", "infohash", mt.InfoHash.String(), "error", err)
+	}
+}
+
+// checkTorrent hashes the data of a torrent instead of trusting the cached bitfield,
+// a seed must have every piece
+func (p *Peer) checkTorrent(mt *managedTorrent) error {
+	mt.setState(StateChecking)
+	mt.mu.Lock()
+	seeding, dataPath := mt.seeding, mt.dataPath
+	mt.mu.Unlock()
+
+	bitfield := connection.NewBitField(mt.NumPieces())
+	if seeding {
+		if err := storage.CheckComplete(mt.TorrentFile, dataPath); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(dataPath); err == nil {
+		data, err := p.storage.Open(mt.TorrentFile, dataPath)
+		if err != nil {
+			return err
+		}
+		bitfield = verifyPieces(mt.TorrentFile, data)
+		data.Close()
+	} else if !os.IsNotExist(err) || seeding {
+		return err
+	}
+
+	valid := bitfield.NumPieces()
+	if seeding && valid != mt.NumPieces() {
+		return fmt.Errorf("Data is incomplete, %d of %d pieces are valid", valid, mt.NumPieces())
+	}
+
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	if cache, ok := p.cache[mt.InfoHash.String()]; ok {
+		cache.Bitfield = bitfield
+	}
+	return nil
+}
+
+// verifyPieces returns the bitfield of the pieces matching their hash
+func verifyPieces(tf *torrent.TorrentFile, data storage.Torrent) connection.BitField {
+	bitfield := connection.NewBitField(tf.NumPieces())
+	buf := make([]byte, tf.PieceLength)
+	for i := 0; i < tf.NumPieces(); i++ {
+		begin, end := tf.PieceBounds(i)
+		piece := buf[:end-begin]
+		if _, err := data.ReadAt(piece, i, 0); err != nil {
+			continue
+		}
+		if sha1.Sum(piece) == tf.PieceHashes[i] {
+			bitfield.SetPiece(i)
+		}
+	}
+	return bitfield
+}
+
+// addExisting adds a torrent whose data may already be on disk, e.g. copied from
+// another machine, the valid pieces are seeded and the missing ones downloaded
+func (p *Peer) addExisting(ctx context.Context, tf *torrent.TorrentFile, dataPath string) error {
+	mt, err := p.torrents.add(tf, filepath.Dir(dataPath))
+	if p.addedRestored(tf, err) {
+		logger.Info("Torrent already restored", "infohash", tf.InfoHash.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mt.setDataPath(dataPath)
+	if err := p.cacheTorrent(mt); err != nil {
+		logger.Error("Failed to cache torrent", "error", err)
+	}
+	p.cacheMu.Lock()
+	if cache, ok := p.cache[tf.InfoHash.String()]; ok {
+		cache.Existing = true
+	}
+	p.cacheMu.Unlock()
+	if err := p.checkTorrent(mt); err != nil {
+		mt.fail(err)
+		return err
+	}
+
+	p.cacheMu.Lock()
+	valid := p.cache[tf.InfoHash.String()].Bitfield.NumPieces()
+	p.cacheMu.Unlock()
+	logger.Info("Checked existing data", "infohash", tf.InfoHash.String(), "valid", valid, "pieces", tf.NumPieces())
+	if valid == tf.NumPieces() {
+		mt.seed(dataPath, p.config.SuperSeeding)
+		p.cacheSeed(mt)
+	}
+	if err := p.saveCache(); err != nil {
+		logger.Error("Failed to save cache", "error", err)
+	}
+	return p.runTorrent(ctx, mt)
+}
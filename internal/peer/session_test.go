@@ -0,0 +1,241 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/peers"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestRestoreSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	seedPath := filepath.Join(dir, "seed.bin")
+	if err := os.WriteFile(seedPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seedTF := testTorrent(data, 4)
+	seedTF.Announce = tracker.URL
+	seedTF.Name = "seed.bin"
+	seedTF.InfoHash[0] = 0x41
+
+	downloadTF := testTorrent(data, 4)
+	downloadTF.Announce = tracker.URL
+	downloadTF.Name = "download.bin"
+	downloadTF.InfoHash[0] = 0x42
+	cachePath := filepath.Join(dir, "cache.json")
+
+	p := newTestPeer(t, cachePath)
+	seeded := make(chan error, 1)
+	go func() { seeded <- p.seedTorrent(ctx, seedTF, seedPath, true) }()
+	waitForState(t, p, seedTF.InfoHash, StateSeeding)
+	if err := p.seedTorrent(ctx, seedTF, seedPath, true); !errors.Is(err, ErrTorrentExists) {
+		t.Errorf("Expected ErrTorrentExists for a torrent added twice, got %v", err)
+	}
+	if err := p.SetSeedLimits(seedTF.InfoHash, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the tracker has no peers so the download is never started
+	mt, err := p.torrents.add(downloadTF, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.cacheTorrent(mt); err != nil {
+		t.Fatalf("Failed to cache torrent: %s", err)
+	}
+	// the first piece was downloaded
+	if err := os.WriteFile(filepath.Join(dir, "download.bin.tmp"), []byte("0123xxxx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	p = newTestPeer(t, cachePath)
+	p.config.VerifyOnRestore = true
+	p.restoreSession()
+	if n := len(p.restored); n != 2 {
+		t.Fatalf("Expected 2 restored torrents, got %d", n)
+	}
+	for _, r := range p.restored {
+		if r.check {
+			t.Errorf("Expected the data of %s to be unchanged", r.mt.Name)
+		}
+	}
+
+	seed, ok := p.torrents.get(seedTF.InfoHash)
+	if !ok {
+		t.Fatalf("Expected the seed to be restored")
+	}
+	if !seed.seeding || !seed.superSeed || seed.dataPath != seedPath || seed.ratioLimit != 3 {
+		t.Errorf("Expected the seed settings to be restored, got %+v", seed.info())
+	}
+	if seed.Name != seedTF.Name || seed.NumPieces() != seedTF.NumPieces() {
+		t.Errorf("Expected the metainfo to be restored")
+	}
+	if err := p.checkTorrent(seed); err != nil {
+		t.Errorf("Expected the seed data to be valid, got %s", err)
+	}
+
+	download, ok := p.torrents.get(downloadTF.InfoHash)
+	if !ok {
+		t.Fatalf("Expected the download to be restored")
+	}
+	if download.seeding || download.path != dir {
+		t.Errorf("Expected a download to %s, got %+v", dir, download.info())
+	}
+	if err := p.checkTorrent(download); err != nil {
+		t.Fatalf("Failed to check download: %s", err)
+	}
+	bitfield := p.cache[downloadTF.InfoHash.String()].Bitfield
+	if !bitfield.HasPiece(0) || bitfield.HasPiece(1) || bitfield.HasPiece(2) {
+		t.Errorf("Expected only the first piece to be valid, got %08b", bitfield)
+	}
+
+	// the torrents given again on start are already there
+	if err := p.download(ctx, downloadTF, dir); err != nil {
+		t.Errorf("Expected the restored download to be kept, got %s", err)
+	}
+	if err := p.seedTorrent(ctx, seedTF, seedPath, true); err != nil {
+		t.Errorf("Expected the restored seed to be kept, got %s", err)
+	}
+	if mt, _ := p.torrents.get(downloadTF.InfoHash); mt != download {
+		t.Errorf("Expected the restored download to be left to Run")
+	}
+
+	// the restored seed runs again
+	go p.startRestored(ctx, seed, false)
+	waitForState(t, p, seedTF.InfoHash, StateSeeding)
+
+	if err := p.Pause(seedTF.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(seedPath, []byte("corrupted!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkTorrent(seed); err == nil {
+		t.Errorf("Expected corrupted seed data to fail the check")
+	}
+}
+
+func TestAddExisting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := newFakeTracker(t)
+
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef01")
+	seedPath := filepath.Join(dir, "seed", "file.bin")
+	if err := os.MkdirAll(filepath.Dir(seedPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(seedPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent(data, 4)
+	tf.Announce = tracker.URL
+	tf.InfoHash = torrent.Sha1Hash{0xa1}
+
+	// the valid pieces of partial data are served while the rest is downloaded
+	sharedPath := filepath.Join(dir, "shared", "file.bin")
+	if err := os.MkdirAll(filepath.Dir(sharedPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sharedPath, []byte("0123xxxx89ab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a peer that never answers keeps the download going
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	tracker.setPeers(peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(silent.Addr().(*net.TCPAddr).Port)})
+	sharer := newTestPeer(t, filepath.Join(dir, "sharer.json"))
+	sharer.PeerID = [20]byte{3}
+	sharer.Port = freePort(t)
+	go sharer.Run(ctx)
+	go sharer.addExisting(ctx, tf, sharedPath)
+	waitForState(t, sharer, tf.InfoHash, StateDownloading)
+	tracker.setPeers(peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: sharer.Port})
+	third := newTestPeer(t, filepath.Join(dir, "third.json"))
+	third.PeerID = [20]byte{4}
+	go third.download(ctx, tf, filepath.Join(dir, "third"))
+	waitForState(t, third, tf.InfoHash, StateDownloading)
+	thirdMT, _ := third.torrents.get(tf.InfoHash)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sw := thirdMT.getSwarm()
+		if sw != nil && sw.data.Completed().HasPiece(0) && sw.data.Completed().HasPiece(2) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the verified pieces to be downloaded from the partial data")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mt, _ := sharer.torrents.get(tf.InfoHash); mt.State() != StateDownloading {
+		t.Errorf("Expected the partial data to still be downloading, got %s", mt.State())
+	}
+
+	// complete data is seeded right away
+	seeder := newTestPeer(t, filepath.Join(dir, "seeder.json"))
+	seeder.Port = freePort(t)
+	go seeder.Run(ctx)
+	go seeder.addExisting(ctx, tf, seedPath)
+	waitForState(t, seeder, tf.InfoHash, StateSeeding)
+	tracker.setPeers(peers.Peer{Ip: net.IPv4(127, 0, 0, 1), Port: seeder.Port})
+
+	// the corrupted and missing pieces are downloaded, the data is completed
+	// in place even inside the incomplete directory
+	partialPath := filepath.Join(dir, "partial", "data.bin")
+	if err := os.MkdirAll(filepath.Dir(partialPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath, []byte("0123xxxx89ab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	leecher := newTestPeer(t, filepath.Join(dir, "leecher.json"))
+	leecher.PeerID = [20]byte{2}
+	leecher.config.SeedOnFileDownloaded = true
+	leecher.config.IncompleteDir = filepath.Dir(partialPath)
+	leecher.config.CompletedDir = filepath.Join(dir, "completed")
+	go leecher.addExisting(ctx, tf, partialPath)
+	waitForState(t, leecher, tf.InfoHash, StateSeeding)
+
+	got, err := os.ReadFile(partialPath)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("Expected the data to be completed in place, got %q (%v)", got, err)
+	}
+	mt, _ := leecher.torrents.get(tf.InfoHash)
+	if info := mt.info(); info.Path != partialPath {
+		t.Errorf("Expected seeding from %s, got %s", partialPath, info.Path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "completed", tf.Name)); !os.IsNotExist(err) {
+		t.Errorf("Expected the existing data not to be moved, got %v", err)
+	}
+	// only the missing pieces were downloaded
+	if downloaded := mt.counters.downloaded.Load(); downloaded != int64(len(data)-8) {
+		t.Errorf("Expected %d bytes downloaded, got %d", len(data)-8, downloaded)
+	}
+}
@@ -0,0 +1,504 @@
+package storage
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// Preallocation modes of the files of a torrent
+const (
+	PreallocateNone   = "none"
+	PreallocateSparse = "sparse"
+	PreallocateFull   = "full"
+)
+
+// Writes of adjacent blocks are merged up to this size
+const maxCoalescedWrite = 4 * 1024 * 1024
+
+type DiskIOConfig struct {
+	// Number of goroutines writing to disk
+	Workers int
+	// Bytes of pending writes, writers block when the cache is full
+	WriteCacheSize int
+	// Bytes of completed pieces kept in memory for reads, 0 disables the cache
+	ReadCacheSize int
+	// none, sparse or full
+	Preallocation string
+}
+
+// preallocator is implemented by the storages backed by files
+type preallocator interface {
+	Preallocate(t *torrent.TorrentFile, path string, mode string) error
+}
+
+// DiskIO wraps a storage so that writes are buffered in a bounded write-back
+// cache and flushed by a pool of workers, and reads of hot pieces
+// are served from memory. Network goroutines only block on disk
+// when the write cache is full.
+type DiskIO struct {
+	backend Storage
+	cfg     DiskIOConfig
+
+	jobs chan func()
+	done chan struct{}
+	wg   sync.WaitGroup
+	// held for reading while submitting, so that no job is lost when closing
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu sync.Mutex
+
+	// bytes of pending writes
+	budget     *sync.Cond
+	cachedSize int
+
+	reads *readCache
+}
+
+func NewDiskIO(backend Storage, cfg DiskIOConfig) *DiskIO {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.WriteCacheSize <= 0 {
+		cfg.WriteCacheSize = maxCoalescedWrite
+	}
+
+	d := &DiskIO{
+		backend: backend,
+		cfg:     cfg,
+		jobs:    make(chan func(), cfg.Workers*16),
+		done:    make(chan struct{}),
+		reads:   newReadCache(cfg.ReadCacheSize),
+	}
+	d.budget = sync.NewCond(&d.mu)
+
+	for range cfg.Workers {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+func (d *DiskIO) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			// run the jobs left in the queue
+			for {
+				select {
+				case job := <-d.jobs:
+					job()
+				default:
+					return
+				}
+			}
+		case job := <-d.jobs:
+			job()
+		}
+	}
+}
+
+// submit queues a job for the workers, after Close the job runs on the caller
+func (d *DiskIO) submit(job func()) {
+	d.closeMu.RLock()
+	if !d.closed {
+		d.jobs <- job
+		d.closeMu.RUnlock()
+		return
+	}
+	d.closeMu.RUnlock()
+	job()
+}
+
+// Close stops the workers once the queued jobs are done,
+// torrents still open write synchronously afterwards
+func (d *DiskIO) Close() {
+	d.closeMu.Lock()
+	if d.closed {
+		d.closeMu.Unlock()
+		return
+	}
+	d.closed = true
+	d.closeMu.Unlock()
+
+	close(d.done)
+	d.wg.Wait()
+}
+
+func (d *DiskIO) reserve(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// a single write larger than the cache is let through when the cache is empty
+	for d.cachedSize > 0 && d.cachedSize+n > d.cfg.WriteCacheSize {
+		d.budget.Wait()
+	}
+	d.cachedSize += n
+}
+
+func (d *DiskIO) release(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cachedSize -= n
+	d.budget.Broadcast()
+}
+
+func (d *DiskIO) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	if p, ok := d.backend.(preallocator); ok && d.cfg.Preallocation != "" && d.cfg.Preallocation != PreallocateNone {
+		if err := p.Preallocate(t, path, d.cfg.Preallocation); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, err := d.backend.Open(t, path)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := &cachedTorrent{
+		d:         d,
+		t:         t,
+		backend:   backend,
+		completed: backend.Completed(),
+	}
+	ct.written = sync.NewCond(&ct.mu)
+	return ct, nil
+}
+
+// A buffered write at an offset of the torrent data
+type extent struct {
+	off int64
+	buf []byte
+}
+
+func (e *extent) end() int64 {
+	return e.off + int64(len(e.buf))
+}
+
+func (e *extent) overlaps(off, end int64) bool {
+	return e.off < end && off < e.end()
+}
+
+type cachedTorrent struct {
+	d       *DiskIO
+	t       *torrent.TorrentFile
+	backend Torrent
+
+	mu sync.Mutex
+	// signaled every time a flush finishes
+	written *sync.Cond
+	// sorted by offset, not picked up by a worker yet
+	pending []*extent
+	// being written by a worker
+	inflight []*extent
+	// first error of an asynchronous write, returned by the next call
+	err       error
+	completed connection.BitField
+}
+
+func (ct *cachedTorrent) overlapping(off, end int64) bool {
+	for _, e := range ct.pending {
+		if e.overlaps(off, end) {
+			return true
+		}
+	}
+	for _, e := range ct.inflight {
+		if e.overlaps(off, end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ct *cachedTorrent) takeError() error {
+	err := ct.err
+	ct.err = nil
+	return err
+}
+
+func (ct *cachedTorrent) WriteAt(b []byte, piece int, begin int) (int, error) {
+	pieceBegin, pieceEnd := ct.t.PieceBounds(piece)
+	if piece < 0 || piece >= ct.t.NumPieces() || begin < 0 || pieceBegin+begin+len(b) > pieceEnd {
+		return 0, ErrOutOfBound
+	}
+	off := int64(pieceBegin + begin)
+
+	ct.d.reserve(len(b))
+	buf := make([]byte, len(b))
+	copy(buf, b)
+
+	ct.mu.Lock()
+	// the order of overlapping writes must be kept, wait for the older ones
+	for ct.overlapping(off, off+int64(len(b))) {
+		ct.written.Wait()
+	}
+	if err := ct.takeError(); err != nil {
+		ct.mu.Unlock()
+		ct.d.release(len(b))
+		return 0, err
+	}
+
+	i := sort.Search(len(ct.pending), func(i int) bool { return ct.pending[i].off > off })
+	ct.pending = append(ct.pending, nil)
+	copy(ct.pending[i+1:], ct.pending[i:])
+	ct.pending[i] = &extent{off: off, buf: buf}
+	ct.mu.Unlock()
+
+	ct.d.reads.remove(ct, piece)
+	ct.schedule()
+	return len(b), nil
+}
+
+// Every buffered write schedules one flush, and every flush writes at least
+// one extent, so waiting on written always makes progress
+func (ct *cachedTorrent) schedule() {
+	ct.d.submit(ct.flushRun)
+}
+
+// flushRun writes the first run of adjacent pending extents as a single write
+func (ct *cachedTorrent) flushRun() {
+	ct.mu.Lock()
+	if len(ct.pending) == 0 {
+		ct.mu.Unlock()
+		return
+	}
+	n, size := 1, len(ct.pending[0].buf)
+	for n < len(ct.pending) && ct.pending[n].off == ct.pending[n-1].end() && size+len(ct.pending[n].buf) <= maxCoalescedWrite {
+		size += len(ct.pending[n].buf)
+		n++
+	}
+	run := make([]*extent, n)
+	copy(run, ct.pending[:n])
+	ct.pending = ct.pending[n:]
+	ct.inflight = append(ct.inflight, run...)
+	ct.mu.Unlock()
+
+	err := ct.writeRun(run, size)
+
+	ct.mu.Lock()
+	remaining := ct.inflight[:0]
+	for _, e := range ct.inflight {
+		if !containsExtent(run, e) {
+			remaining = append(remaining, e)
+		}
+	}
+	ct.inflight = remaining
+	if err != nil && ct.err == nil {
+		ct.err = err
+	}
+	ct.written.Broadcast()
+	ct.mu.Unlock()
+
+	ct.d.release(size)
+}
+
+func containsExtent(run []*extent, e *extent) bool {
+	for _, r := range run {
+		if r == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (ct *cachedTorrent) writeRun(run []*extent, size int) error {
+	// storages laid out as files can take the coalesced write at once
+	if raw, ok := ct.backend.(*pieceStorage); ok {
+		buf := run[0].buf
+		if len(run) > 1 {
+			buf = make([]byte, 0, size)
+			for _, e := range run {
+				buf = append(buf, e.buf...)
+			}
+		}
+		_, err := raw.rawWriteAt(buf, run[0].off)
+		return err
+	}
+
+	for _, e := range run {
+		if err := ct.writeExtent(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExtent splits the extent into writes addressed by piece
+func (ct *cachedTorrent) writeExtent(e *extent) error {
+	off, buf := e.off, e.buf
+	for len(buf) > 0 {
+		piece := int(off / int64(ct.t.PieceLength))
+		pieceBegin, pieceEnd := ct.t.PieceBounds(piece)
+		n := min(len(buf), pieceEnd-int(off))
+		if _, err := ct.backend.WriteAt(buf[:n], piece, int(off)-pieceBegin); err != nil {
+			return err
+		}
+		off += int64(n)
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func (ct *cachedTorrent) ReadAt(b []byte, piece int, begin int) (int, error) {
+	pieceBegin, pieceEnd := ct.t.PieceBounds(piece)
+	if piece < 0 || piece >= ct.t.NumPieces() || begin < 0 || pieceBegin+begin+len(b) > pieceEnd {
+		return 0, ErrOutOfBound
+	}
+	off := int64(pieceBegin + begin)
+	end := off + int64(len(b))
+
+	ct.mu.Lock()
+	// serve the read from a buffered write if it covers the whole range
+	for _, extents := range [][]*extent{ct.pending, ct.inflight} {
+		for _, e := range extents {
+			if e.off <= off && end <= e.end() {
+				n := copy(b, e.buf[off-e.off:])
+				ct.mu.Unlock()
+				return n, nil
+			}
+		}
+	}
+	for ct.overlapping(off, end) {
+		ct.written.Wait()
+	}
+	complete := ct.completed.HasPiece(piece)
+	ct.mu.Unlock()
+
+	if !complete || ct.d.reads.capacity == 0 {
+		return ct.backend.ReadAt(b, piece, begin)
+	}
+
+	buf, err := ct.d.reads.get(ct, piece, func() ([]byte, error) {
+		buf := make([]byte, pieceEnd-pieceBegin)
+		_, err := ct.backend.ReadAt(buf, piece, 0)
+		return buf, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, buf[begin:]), nil
+}
+
+func (ct *cachedTorrent) MarkComplete(piece int) error {
+	if err := ct.backend.MarkComplete(piece); err != nil {
+		return err
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.completed.SetPiece(piece)
+	return nil
+}
+
+func (ct *cachedTorrent) Completed() connection.BitField {
+	return ct.backend.Completed()
+}
+
+func (ct *cachedTorrent) Flush() error {
+	ct.mu.Lock()
+	for len(ct.pending) > 0 || len(ct.inflight) > 0 {
+		ct.written.Wait()
+	}
+	err := ct.takeError()
+	ct.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ct.backend.Flush()
+}
+
+func (ct *cachedTorrent) Close() error {
+	err := ct.Flush()
+	ct.d.reads.removeTorrent(ct)
+	if cerr := ct.backend.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type readCacheKey struct {
+	t     *cachedTorrent
+	piece int
+}
+
+type readCacheEntry struct {
+	key readCacheKey
+	buf []byte
+}
+
+// readCache is a least recently used cache of whole pieces shared by all torrents
+type readCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List
+	entries  map[readCacheKey]*list.Element
+}
+
+func newReadCache(capacity int) *readCache {
+	return &readCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[readCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached piece, or loads and caches it
+func (c *readCache) get(t *cachedTorrent, piece int, load func() ([]byte, error)) ([]byte, error) {
+	key := readCacheKey{t, piece}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		buf := el.Value.(*readCacheEntry).buf
+		c.mu.Unlock()
+		return buf, nil
+	}
+	c.mu.Unlock()
+
+	buf, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > c.capacity {
+		return buf, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&readCacheEntry{key: key, buf: buf})
+		c.size += len(buf)
+	}
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+	return buf, nil
+}
+
+func (c *readCache) removeElement(el *list.Element) {
+	entry := c.lru.Remove(el).(*readCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.buf)
+}
+
+func (c *readCache) remove(t *cachedTorrent, piece int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[readCacheKey{t, piece}]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *readCache) removeTorrent(t *cachedTorrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if key.t == t {
+			c.removeElement(el)
+		}
+	}
+}
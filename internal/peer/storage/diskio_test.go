@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestDiskIORoundTrip(t *testing.T) {
+	cfg := DiskIOConfig{Workers: 2, WriteCacheSize: 8, ReadCacheSize: 8}
+
+	d := NewDiskIO(NewMemoryStorage(), cfg)
+	defer d.Close()
+	testRoundTrip(t, d, singleFileTorrent(), "file.bin")
+	testRoundTrip(t, d, multiFileTorrent(), "dir")
+
+	cfg.Preallocation = PreallocateFull
+	files := NewDiskIO(NewFileStorage(), cfg)
+	defer files.Close()
+	testRoundTrip(t, files, multiFileTorrent(), filepath.Join(t.TempDir(), "dir"))
+}
+
+func TestDiskIOPreallocation(t *testing.T) {
+	for _, mode := range []string{PreallocateSparse, PreallocateFull} {
+		path := filepath.Join(t.TempDir(), "file.bin")
+		d := NewDiskIO(NewFileStorage(), DiskIOConfig{Preallocation: mode})
+
+		st, err := d.Open(singleFileTorrent(), path)
+		if err != nil {
+			t.Fatalf("Failed to open with %s preallocation: %s", mode, err)
+		}
+		st.Close()
+		d.Close()
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != 10 {
+			t.Errorf("Expected %s preallocation to create 10 bytes, got %d", mode, stat.Size())
+		}
+	}
+}
+
+// blockingData counts writes, the first write blocks until released
+type blockingData struct {
+	buffer
+	mu       sync.Mutex
+	writes   int
+	started  chan struct{}
+	released chan struct{}
+}
+
+func (b *blockingData) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	b.writes++
+	first := b.writes == 1
+	b.mu.Unlock()
+	if first {
+		close(b.started)
+		<-b.released
+	}
+	return b.buffer.WriteAt(p, off)
+}
+
+type blockingStorage struct {
+	data *blockingData
+}
+
+func (s *blockingStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	return newPieceStorage(t, s.data), nil
+}
+
+func TestDiskIOCoalescesWrites(t *testing.T) {
+	data := newBlockingData(12)
+	d := NewDiskIO(&blockingStorage{data: data}, DiskIOConfig{Workers: 1, WriteCacheSize: 64})
+	defer d.Close()
+
+	tf := singleFileTorrent()
+	tf.Length = 12
+	st, err := d.Open(tf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.WriteAt([]byte("aaaa"), 0, 0)
+	<-data.started
+
+	// the worker is busy, so these two adjacent pieces are written at once
+	st.WriteAt([]byte("bbbb"), 1, 0)
+	st.WriteAt([]byte("cccc"), 2, 0)
+
+	// pending writes are readable before they hit the disk
+	buf := make([]byte, 4)
+	if _, err := st.ReadAt(buf, 2, 0); err != nil || string(buf) != "cccc" {
+		t.Errorf("Expected to read pending write %q, got %q (%v)", "cccc", buf, err)
+	}
+
+	close(data.released)
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data.b) != "aaaabbbbcccc" {
+		t.Errorf("Expected %q on disk, got %q", "aaaabbbbcccc", data.b)
+	}
+	if data.writes != 2 {
+		t.Errorf("Expected 2 disk writes, got %d", data.writes)
+	}
+}
+
+func newBlockingData(size int) *blockingData {
+	return &blockingData{
+		buffer:   buffer{b: make([]byte, size)},
+		started:  make(chan struct{}),
+		released: make(chan struct{}),
+	}
+}
+
+// writeAsync writes in the background, the channel is closed once the write returns
+func writeAsync(st Torrent, b []byte, piece, begin int) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		st.WriteAt(b, piece, begin)
+		close(done)
+	}()
+	return done
+}
+
+// expectBlocked fails unless the write is still blocked after a while
+func expectBlocked(t *testing.T, done chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatalf("Expected the write to block when %s", what)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectUnblocked(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the write to go through")
+	}
+}
+
+func TestDiskIOBackPressure(t *testing.T) {
+	t.Run("write cache", func(t *testing.T) {
+		data := newBlockingData(12)
+		d := NewDiskIO(&blockingStorage{data: data}, DiskIOConfig{Workers: 1, WriteCacheSize: 8})
+		defer d.Close()
+		// a failing test must not leave the worker stuck when closing
+		release := sync.OnceFunc(func() { close(data.released) })
+		defer release()
+		tf := singleFileTorrent()
+		tf.Length = 12
+		st, err := d.Open(tf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st.WriteAt([]byte("aaaa"), 0, 0)
+		<-data.started
+		// fills the cache with the write the worker is stuck on
+		st.WriteAt([]byte("bbbb"), 1, 0)
+		done := writeAsync(st, []byte("cccc"), 2, 0)
+		expectBlocked(t, done, "the write cache is full")
+		d.mu.Lock()
+		cached := d.cachedSize
+		d.mu.Unlock()
+		if cached != 8 {
+			t.Errorf("Expected 8 bytes cached, got %d", cached)
+		}
+
+		release()
+		expectUnblocked(t, done)
+		if err := st.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if string(data.b) != "aaaabbbbcccc" {
+			t.Errorf("Expected %q on disk, got %q", "aaaabbbbcccc", data.b)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		const queued = 16
+		data := newBlockingData(queued + 2)
+		d := NewDiskIO(&blockingStorage{data: data}, DiskIOConfig{Workers: 1, WriteCacheSize: 1024})
+		defer d.Close()
+		// a failing test must not leave the worker stuck when closing
+		release := sync.OnceFunc(func() { close(data.released) })
+		defer release()
+		tf := &torrent.TorrentFile{Name: "file.bin", PieceLength: 1, Length: queued + 2, PieceHashes: make([]torrent.Sha1Hash, queued+2)}
+		st, err := d.Open(tf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st.WriteAt([]byte("a"), 0, 0)
+		<-data.started
+		// the worker is stuck, every write queues a flush until the queue is full
+		for piece := 1; piece <= queued; piece++ {
+			st.WriteAt([]byte("b"), piece, 0)
+		}
+		done := writeAsync(st, []byte("c"), queued+1, 0)
+		expectBlocked(t, done, "the queue is full")
+
+		release()
+		expectUnblocked(t, done)
+		if err := st.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if want := "a" + strings.Repeat("b", queued) + "c"; string(data.b) != want {
+			t.Errorf("Expected %q on disk, got %q", want, data.b)
+		}
+	})
+}
+
+// countingData counts the reads reaching the disk
+type countingData struct {
+	buffer
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingData) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.buffer.ReadAt(p, off)
+}
+
+func (c *countingData) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+type countingStorage struct {
+	data *countingData
+}
+
+func (s *countingStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	return newPieceStorage(t, s.data), nil
+}
+
+func TestDiskIOReadCache(t *testing.T) {
+	data := &countingData{buffer: buffer{b: make([]byte, 12)}}
+	// room for two pieces
+	d := NewDiskIO(&countingStorage{data: data}, DiskIOConfig{Workers: 1, ReadCacheSize: 8})
+	defer d.Close()
+	tf := singleFileTorrent()
+	tf.Length = 12
+	st, err := d.Open(tf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for piece, content := range []string{"aaaa", "bbbb", "cccc"} {
+		st.WriteAt([]byte(content), piece, 0)
+		st.MarkComplete(piece)
+	}
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(piece, begin, length int, reads int) {
+		t.Helper()
+		buf := make([]byte, length)
+		if _, err := st.ReadAt(buf, piece, begin); err != nil {
+			t.Fatalf("Failed to read piece %d: %s", piece, err)
+		}
+		if want := strings.Repeat(string(rune('a'+piece)), length); string(buf) != want {
+			t.Errorf("Expected %q from piece %d, got %q", want, piece, buf)
+		}
+		if got := data.count(); got != reads {
+			t.Errorf("Expected %d disk reads after reading piece %d, got %d", reads, piece, got)
+		}
+	}
+
+	// the whole piece is read once, then every block is served from memory
+	read(0, 0, 2, 1)
+	read(0, 2, 2, 1)
+	read(1, 0, 4, 2)
+	// piece 0 is now the most recently used, reading piece 2 evicts piece 1
+	read(0, 0, 4, 2)
+	read(2, 0, 4, 3)
+	read(0, 0, 4, 3)
+	read(1, 0, 4, 4)
+
+	// a write drops the cached piece
+	st.WriteAt([]byte("bbbb"), 1, 0)
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	read(1, 0, 4, 5)
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the disk blocks of the file,
+// falling back to a sparse file if the filesystem does not support it
+func fallocate(fd *os.File, length int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return fd.Truncate(length)
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// fallocate is only available on linux, other platforms get a sparse file
+func fallocate(fd *os.File, length int64) error {
+	return fd.Truncate(length)
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// FileStorage stores the torrent in plain files, a single file torrent
+// is stored as one file, a multi-file torrent uses the multi-file layout
+type FileStorage struct{}
+
+func NewFileStorage() *FileStorage {
+	return &FileStorage{}
+}
+
+func (s *FileStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	if t.IsMultiFile() {
+		return NewMultiFileStorage().Open(t, path)
+	}
+
+	fd, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPieceStorage(t, spanned{{
+		offset: 0,
+		length: int64(t.Length),
+		data:   fd,
+		closer: fd,
+	}}), nil
+}
+
+func (s *FileStorage) Preallocate(t *torrent.TorrentFile, path string, mode string) error {
+	return preallocateFiles(t, path, mode)
+}
+
+// MultiFileStorage stores each file of a multi-file torrent
+// under the directory of the torrent
+type MultiFileStorage struct{}
+
+func NewMultiFileStorage() *MultiFileStorage {
+	return &MultiFileStorage{}
+}
+
+func (s *MultiFileStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	paths, err := FilePaths(t, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files spanned
+	var offset int64
+	for i, fp := range paths {
+		fd, err := openFile(fp)
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+		length := int64(Layout(t)[i].Length)
+		files = append(files, segment{
+			offset: offset,
+			length: length,
+			data:   fd,
+			closer: fd,
+		})
+		offset += length
+	}
+
+	return newPieceStorage(t, files), nil
+}
+
+func (s *MultiFileStorage) Preallocate(t *torrent.TorrentFile, path string, mode string) error {
+	return preallocateFiles(t, path, mode)
+}
+
+// preallocateFiles grows the files of the torrent to their full length,
+// sparse only sets the size while full reserves the disk blocks
+func preallocateFiles(t *torrent.TorrentFile, path string, mode string) error {
+	if mode != PreallocateSparse && mode != PreallocateFull {
+		return fmt.Errorf("Unknown preallocation mode %q", mode)
+	}
+
+	paths, err := FilePaths(t, path)
+	if err != nil {
+		return err
+	}
+	for i, fp := range paths {
+		length := int64(Layout(t)[i].Length)
+		if err := preallocateFile(fp, length, mode == PreallocateFull); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func preallocateFile(path string, length int64, full bool) error {
+	fd, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	// never shrink existing data
+	if stat.Size() >= length {
+		return nil
+	}
+	if full {
+		return fallocate(fd, length)
+	}
+	return fd.Truncate(length)
+}
+
+// Layout returns the files of the torrent, a single file torrent
+// is a layout with one file named after the torrent
+func Layout(t *torrent.TorrentFile) []torrent.File {
+	if !t.IsMultiFile() {
+		return []torrent.File{{Length: t.Length, Path: []string{t.Name}}}
+	}
+	return t.Files
+}
+
+// FilePaths returns the paths of the files of the torrent stored at path
+func FilePaths(t *torrent.TorrentFile, path string) ([]string, error) {
+	if !t.IsMultiFile() {
+		return []string{path}, nil
+	}
+
+	paths := make([]string, 0, len(t.Files))
+	for _, f := range t.Files {
+		// do not let a malicious torrent escape its directory
+		for _, part := range f.Path {
+			if part == "" || part == "." || part == ".." || filepath.Base(part) != part {
+				return nil, fmt.Errorf("Invalid file path in torrent: %v", f.Path)
+			}
+		}
+		if len(f.Path) == 0 {
+			return nil, fmt.Errorf("Empty file path in torrent")
+		}
+		paths = append(paths, filepath.Join(append([]string{path}, f.Path...)...))
+	}
+	return paths, nil
+}
+
+// CheckComplete makes sure every file of the torrent stored at path has its full
+// length, so that complete data is never created, e.g. filled with zeros
+func CheckComplete(t *torrent.TorrentFile, path string) error {
+	paths, err := FilePaths(t, path)
+	if err != nil {
+		return err
+	}
+	for i, fp := range paths {
+		info, err := os.Stat(fp)
+		if err != nil {
+			return err
+		}
+		length := int64(Layout(t)[i].Length)
+		if !info.Mode().IsRegular() || info.Size() != length {
+			return fmt.Errorf("%w: %s is %d bytes instead of %d", ErrIncomplete, fp, info.Size(), length)
+		}
+	}
+	return nil
+}
+
+func openFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
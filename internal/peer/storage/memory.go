@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"io"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// MemoryStorage keeps the torrent data in memory, mostly useful for tests.
+// The data of a path survives closing the torrent and is shared
+// between torrents opened at the same path
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]*buffer
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: make(map[string]*buffer),
+	}
+}
+
+func (s *MemoryStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, ok := s.files[path]
+	if !ok || len(buf.b) != t.Length {
+		buf = &buffer{b: make([]byte, t.Length)}
+		s.files[path] = buf
+	}
+	return newPieceStorage(t, buf), nil
+}
+
+// buffer is a fixed size byte slice safe for concurrent use
+type buffer struct {
+	mu sync.RWMutex
+	b  []byte
+}
+
+func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return readAt(b.b, p, off)
+}
+
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return writeAt(b.b, p, off)
+}
+
+func (b *buffer) Close() error {
+	return nil
+}
+
+// region is a byte slice accessed with offsets, such as a memory mapped file
+type region []byte
+
+func (r region) ReadAt(p []byte, off int64) (int, error) {
+	return readAt(r, p, off)
+}
+
+func (r region) WriteAt(p []byte, off int64) (int, error) {
+	return writeAt(r, p, off)
+}
+
+func readAt(b []byte, p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func writeAt(b []byte, p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(b[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+var ErrMmapUnsupported = errors.New("mmap storage is not supported on this platform")
+
+type MmapStorage struct{}
+
+func NewMmapStorage() *MmapStorage {
+	return &MmapStorage{}
+}
+
+func (s *MmapStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	return nil, ErrMmapUnsupported
+}
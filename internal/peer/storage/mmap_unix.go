@@ -0,0 +1,102 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+// MmapStorage maps the files of the torrent into memory,
+// the files are grown to their full length when opened
+type MmapStorage struct{}
+
+func NewMmapStorage() *MmapStorage {
+	return &MmapStorage{}
+}
+
+func (s *MmapStorage) Open(t *torrent.TorrentFile, path string) (Torrent, error) {
+	paths, err := FilePaths(t, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files spanned
+	var offset int64
+	for i, fp := range paths {
+		length := int64(Layout(t)[i].Length)
+		seg, err := mmapFile(fp, length)
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+		seg.offset = offset
+		files = append(files, seg)
+		offset += length
+	}
+
+	return newPieceStorage(t, files), nil
+}
+
+type mapping struct {
+	fd     *os.File
+	region region
+}
+
+// Sync writes the mapped data back to the file
+func (m *mapping) Sync() error {
+	if len(m.region) > 0 {
+		if err := unix.Msync(m.region, unix.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	return m.fd.Sync()
+}
+
+func (m *mapping) Close() error {
+	var err error
+	if len(m.region) > 0 {
+		err = syscall.Munmap(m.region)
+	}
+	return errors.Join(err, m.fd.Close())
+}
+
+func mmapFile(path string, length int64) (segment, error) {
+	fd, err := openFile(path)
+	if err != nil {
+		return segment{}, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return segment{}, err
+	}
+	// never shrink existing data, only the first bytes are mapped
+	if stat.Size() < length {
+		if err := fd.Truncate(length); err != nil {
+			fd.Close()
+			return segment{}, err
+		}
+	}
+
+	m := &mapping{fd: fd}
+	// zero length files cannot be mapped
+	if length > 0 {
+		m.region, err = syscall.Mmap(int(fd.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			fd.Close()
+			return segment{}, err
+		}
+	}
+
+	return segment{
+		length: length,
+		data:   m.region,
+		closer: m,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// A part of the torrent data backed by its own file or buffer
+type segment struct {
+	offset int64
+	length int64
+	data   readerWriterAt
+	closer io.Closer
+}
+
+// spanned lays out segments one after another, so that a read or write
+// crossing a segment boundary is split between the segments
+type spanned []segment
+
+func (s spanned) do(b []byte, off int64, op func(seg segment, b []byte, off int64) (int, error)) (int, error) {
+	n := 0
+	for _, seg := range s {
+		if len(b) == 0 {
+			break
+		}
+		if off >= seg.offset+seg.length || seg.length == 0 {
+			continue
+		}
+		if off < seg.offset {
+			break
+		}
+
+		chunk := b[:min(int64(len(b)), seg.offset+seg.length-off)]
+		m, err := op(seg, chunk, off-seg.offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+		off += int64(m)
+	}
+	if len(b) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s spanned) ReadAt(b []byte, off int64) (int, error) {
+	return s.do(b, off, func(seg segment, b []byte, off int64) (int, error) {
+		return seg.data.ReadAt(b, off)
+	})
+}
+
+func (s spanned) WriteAt(b []byte, off int64) (int, error) {
+	return s.do(b, off, func(seg segment, b []byte, off int64) (int, error) {
+		return seg.data.WriteAt(b, off)
+	})
+}
+
+func (s spanned) Sync() error {
+	var errs []error
+	for _, seg := range s {
+		if syncer, ok := seg.closer.(interface{ Sync() error }); ok {
+			errs = append(errs, syncer.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s spanned) Close() error {
+	var errs []error
+	for _, seg := range s {
+		if seg.closer != nil {
+			errs = append(errs, seg.closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
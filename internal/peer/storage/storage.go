@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+var (
+	ErrOutOfBound     = errors.New("out of bound")
+	ErrUnknownBackend = errors.New("unknown storage backend")
+	ErrIncomplete     = errors.New("data is incomplete")
+)
+
+// Storage opens the data of torrents.
+// For single file torrents the path is the file itself,
+// for multi-file torrents it is the directory containing the files
+type Storage interface {
+	Open(t *torrent.TorrentFile, path string) (Torrent, error)
+}
+
+// Torrent is the opened data of a single torrent, addressed by piece
+type Torrent interface {
+	ReadAt(b []byte, piece int, begin int) (int, error)
+	WriteAt(b []byte, piece int, begin int) (int, error)
+	// Mark the piece as verified and written
+	MarkComplete(piece int) error
+	// Completed returns a copy of the bitfield of completed pieces
+	Completed() connection.BitField
+	// Flush blocks until everything written so far is on disk
+	Flush() error
+	Close() error
+}
+
+// The data of a torrent, addressed by offsets relative to the start of the torrent
+type data interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+const (
+	BackendFile      = "file"
+	BackendMultiFile = "multifile"
+	BackendMmap      = "mmap"
+	BackendMemory    = "memory"
+)
+
+// New returns the storage of the given backend name
+func New(backend string) (Storage, error) {
+	switch backend {
+	case BackendFile, "":
+		return NewFileStorage(), nil
+	case BackendMultiFile:
+		return NewMultiFileStorage(), nil
+	case BackendMmap:
+		return NewMmapStorage(), nil
+	case BackendMemory:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
+
+// pieceStorage translates piece addressing into offsets of the torrent data
+// and keeps track of the completed pieces
+type pieceStorage struct {
+	t    *torrent.TorrentFile
+	data data
+
+	mu        sync.Mutex
+	completed connection.BitField
+}
+
+func newPieceStorage(t *torrent.TorrentFile, d data) *pieceStorage {
+	return &pieceStorage{
+		t:         t,
+		data:      d,
+		completed: connection.NewBitField(t.NumPieces()),
+	}
+}
+
+func (s *pieceStorage) offset(piece, begin, length int) (int64, error) {
+	if piece < 0 || piece >= s.t.NumPieces() {
+		return 0, ErrOutOfBound
+	}
+	pieceBegin, pieceEnd := s.t.PieceBounds(piece)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return 0, ErrOutOfBound
+	}
+	return int64(pieceBegin + begin), nil
+}
+
+func (s *pieceStorage) ReadAt(b []byte, piece int, begin int) (int, error) {
+	off, err := s.offset(piece, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+	return s.data.ReadAt(b, off)
+}
+
+func (s *pieceStorage) WriteAt(b []byte, piece int, begin int) (int, error) {
+	off, err := s.offset(piece, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+	return s.data.WriteAt(b, off)
+}
+
+func (s *pieceStorage) MarkComplete(piece int) error {
+	if piece < 0 || piece >= s.t.NumPieces() {
+		return ErrOutOfBound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed.SetPiece(piece)
+	return nil
+}
+
+func (s *pieceStorage) Completed() connection.BitField {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bf := make(connection.BitField, len(s.completed))
+	copy(bf, s.completed)
+	return bf
+}
+
+// rawWriteAt writes at an offset of the torrent data, bypassing piece addressing
+func (s *pieceStorage) rawWriteAt(b []byte, off int64) (int, error) {
+	return s.data.WriteAt(b, off)
+}
+
+func (s *pieceStorage) Flush() error {
+	if syncer, ok := s.data.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *pieceStorage) Close() error {
+	return s.data.Close()
+}
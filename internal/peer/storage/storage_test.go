@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func singleFileTorrent() *torrent.TorrentFile {
+	return &torrent.TorrentFile{
+		Name:        "file.bin",
+		PieceLength: 4,
+		Length:      10,
+		PieceHashes: make([]torrent.Sha1Hash, 3),
+	}
+}
+
+func multiFileTorrent() *torrent.TorrentFile {
+	return &torrent.TorrentFile{
+		Name:        "dir",
+		PieceLength: 4,
+		Length:      10,
+		PieceHashes: make([]torrent.Sha1Hash, 3),
+		Files: []torrent.File{
+			{Length: 3, Path: []string{"a.bin"}},
+			{Length: 0, Path: []string{"empty.bin"}},
+			{Length: 7, Path: []string{"sub", "b.bin"}},
+		},
+	}
+}
+
+func testRoundTrip(t *testing.T, s Storage, tf *torrent.TorrentFile, path string) {
+	t.Helper()
+	data := []byte("0123456789")
+
+	st, err := s.Open(tf, path)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %s", err)
+	}
+	for i := 0; i < tf.NumPieces(); i++ {
+		begin, end := tf.PieceBounds(i)
+		if _, err := st.WriteAt(data[begin:end], i, 0); err != nil {
+			t.Fatalf("Failed to write piece %d: %s", i, err)
+		}
+		st.MarkComplete(i)
+	}
+	if n := st.Completed().NumPieces(); n != tf.NumPieces() {
+		t.Errorf("Expected %d completed pieces, got %d", tf.NumPieces(), n)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %s", err)
+	}
+
+	// data is still there after reopening
+	st, err = s.Open(tf, path)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %s", err)
+	}
+	defer st.Close()
+
+	buf := make([]byte, 3)
+	if _, err := st.ReadAt(buf, 1, 1); err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	if !bytes.Equal(buf, data[5:8]) {
+		t.Errorf("Expected %q, got %q", data[5:8], buf)
+	}
+
+	if _, err := st.ReadAt(make([]byte, 3), 2, 0); err != ErrOutOfBound {
+		t.Errorf("Expected out of bound reading past the last piece, got %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	testRoundTrip(t, NewFileStorage(), singleFileTorrent(), filepath.Join(dir, "file.bin"))
+	testRoundTrip(t, NewFileStorage(), multiFileTorrent(), filepath.Join(dir, "dir"))
+
+	b, err := os.ReadFile(filepath.Join(dir, "dir", "sub", "b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "3456789" {
+		t.Errorf("Expected second file to contain %q, got %q", "3456789", b)
+	}
+}
+
+func TestMmapStorage(t *testing.T) {
+	dir := t.TempDir()
+	testRoundTrip(t, NewMmapStorage(), singleFileTorrent(), filepath.Join(dir, "file.bin"))
+	testRoundTrip(t, NewMmapStorage(), multiFileTorrent(), filepath.Join(dir, "dir"))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage()
+	testRoundTrip(t, s, singleFileTorrent(), "file.bin")
+	testRoundTrip(t, s, multiFileTorrent(), "dir")
+}
+
+func TestFilePathsRejectsEscapingPaths(t *testing.T) {
+	tf := multiFileTorrent()
+	tf.Files[0].Path = []string{"..", "evil"}
+	if _, err := FilePaths(tf, "dir"); err == nil {
+		t.Errorf("Expected error for path escaping the torrent directory")
+	}
+}
+
+func TestCheckComplete(t *testing.T) {
+	dir := t.TempDir()
+	tf := multiFileTorrent()
+	path := filepath.Join(dir, "dir")
+	if err := CheckComplete(tf, path); !os.IsNotExist(err) {
+		t.Errorf("Expected missing files to be reported, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be created, got %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(path, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, length := range map[string]int{"a.bin": 3, "empty.bin": 0, "sub/b.bin": 6} {
+		if err := os.WriteFile(filepath.Join(path, name), make([]byte, length), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CheckComplete(tf, path); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("Expected a short file to be reported, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "sub", "b.bin"), make([]byte, 7), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckComplete(tf, path); err != nil {
+		t.Errorf("Expected complete data, got %s", err)
+	}
+}
+
+func TestMmapKeepsLongerFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, []byte("0123456789extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewMmapStorage().Open(singleFileTorrent(), path)
+	if err != nil {
+		t.Fatalf("Failed to open: %s", err)
+	}
+	if _, err := st.WriteAt([]byte("abcd"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the mapped data reaches the file before it is unmapped
+	if err := st.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abcd456789extra" {
+		t.Errorf("Expected the extra bytes to be kept, got %q", b)
+	}
+	st.Close()
+}
@@ -0,0 +1,197 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+// how often a reader checks whether the piece it waits for was downloaded
+const streamPollInterval = 100 * time.Millisecond
+
+var (
+	errInvalidWhence    = errors.New("invalid whence")
+	errNegativePosition = errors.New("negative position")
+	errFileNotFound     = errors.New("file not found")
+)
+
+// FileStatus is a file of a torrent as reported by the control API
+type FileStatus struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+func (p *Peer) fileStatuses(mt *managedTorrent) []FileStatus {
+	layout := storage.Layout(mt.TorrentFile)
+	files := make([]FileStatus, len(layout))
+	for i, f := range layout {
+		files[i] = FileStatus{Index: i, Path: path.Join(f.Path...), Length: int64(f.Length)}
+	}
+	return files
+}
+
+// streamReader reads a file of a torrent while it is downloaded, a read blocks until its
+// piece is verified and the pieces from the read offset on are downloaded first
+type streamReader struct {
+	p   *Peer
+	mt  *managedTorrent
+	ctx context.Context
+	// bounds of the file in the torrent
+	begin  int64
+	length int64
+	// offset in the file
+	pos int64
+	// piece the read window was set at, -1 if none
+	cursor int
+	// the complete data, opened when the torrent is not running
+	complete storage.Torrent
+}
+
+func (p *Peer) newStreamReader(ctx context.Context, mt *managedTorrent, index int) *streamReader {
+	layout := storage.Layout(mt.TorrentFile)
+	var begin int64
+	for _, f := range layout[:index] {
+		begin += int64(f.Length)
+	}
+	return &streamReader{
+		p:      p,
+		mt:     mt,
+		ctx:    ctx,
+		begin:  begin,
+		length: int64(layout[index].Length),
+		cursor: -1,
+	}
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errInvalidWhence
+	}
+	if offset < 0 {
+		return 0, errNegativePosition
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	off := r.begin + r.pos
+	piece := int(off / int64(r.mt.PieceLength))
+	pieceBegin, pieceEnd := r.mt.PieceBounds(piece)
+	// a read stops at the end of the piece
+	b = b[:min(int64(len(b)), int64(pieceEnd)-off, r.length-r.pos)]
+
+	if piece != r.cursor {
+		r.cursor = piece
+		r.mt.setRead(r, pieceWindow{cursor: piece, window: max(r.p.config.StreamWindow, 1)})
+	}
+	for {
+		data, err := r.waitPiece(piece)
+		if err != nil {
+			return 0, err
+		}
+		n, err := data.ReadAt(b, piece, int(off)-pieceBegin)
+		if err != nil {
+			// the data was closed between two sessions, e.g. once downloaded
+			if current, _ := r.source(); current != data {
+				continue
+			}
+			return n, err
+		}
+		r.pos += int64(n)
+		return n, nil
+	}
+}
+
+// source returns the data of the torrent, nil until it is running or complete
+func (r *streamReader) source() (storage.Torrent, error) {
+	if r.complete != nil {
+		return r.complete, nil
+	}
+	if sw := r.mt.getSwarm(); sw != nil {
+		return sw.data, nil
+	}
+
+	r.mt.mu.Lock()
+	complete, dataPath := r.mt.seeding || r.mt.downloaded, r.mt.dataPath
+	r.mt.mu.Unlock()
+	if complete {
+		data, err := r.p.openComplete(r.mt.TorrentFile, dataPath)
+		if err != nil {
+			return nil, err
+		}
+		r.complete = data
+		return data, nil
+	}
+	if mt, ok := r.p.torrents.get(r.mt.InfoHash); !ok || mt != r.mt {
+		return nil, ErrTorrentNotFound
+	}
+	return nil, nil
+}
+
+// waitPiece blocks until the piece is verified
+func (r *streamReader) waitPiece(piece int) (storage.Torrent, error) {
+	for {
+		data, err := r.source()
+		if err != nil {
+			return nil, err
+		}
+		if data != nil && data.Completed().HasPiece(piece) {
+			return data, nil
+		}
+		select {
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+func (r *streamReader) Close() error {
+	if r.cursor >= 0 {
+		r.mt.removeRead(r)
+	}
+	if r.complete != nil {
+		return r.complete.Close()
+	}
+	return nil
+}
+
+// serveFile serves a file of the torrent with range requests, while it is downloaded
+func (p *Peer) serveFile(w http.ResponseWriter, r *http.Request, mt *managedTorrent) {
+	files := p.fileStatuses(mt)
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(files) {
+		writeError(w, http.StatusNotFound, errFileNotFound)
+		return
+	}
+
+	// sniffing the type would wait for the first piece, whatever range is requested
+	name := path.Base(files[index].Path)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	sr := p.newStreamReader(r.Context(), mt, index)
+	defer sr.Close()
+	http.ServeContent(w, r, name, time.Time{}, sr)
+}
@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+func getRange(t *testing.T, url, rng string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed to get %s: %s", url, err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read %s: %s", url, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestStreamFile(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef")
+	tf := testTorrent(data, 4)
+	tf.InfoHash = torrent.Sha1Hash{0x5e}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	mt, err := p.torrents.add(tf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := storage.NewMemoryStorage().Open(tf, "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := func(piece int) {
+		begin, end := tf.PieceBounds(piece)
+		st.WriteAt(data[begin:end], piece, 0)
+		st.MarkComplete(piece)
+	}
+	complete(0)
+	complete(1)
+	session := &DownloadSession{picker: testPicker(2, 3)}
+	mt.activate(StateDownloading, newSwarm(tf, st, p.PeerID, false), session)
+
+	c := newControlServer(t, p)
+	hash := tf.InfoHash.String()
+	files, err := c.Files(hash)
+	if err != nil || len(files) != 1 || files[0].Path != "file.bin" || files[0].Length != int64(len(data)) {
+		t.Fatalf("Expected the file of the torrent, got %+v (%v)", files, err)
+	}
+	url := c.FileURL(hash, 0)
+
+	// the verified pieces are served right away
+	if status, body := getRange(t, url, "bytes=2-5"); status != http.StatusPartialContent || body != "2345" {
+		t.Errorf("Expected 2345, got %d %q", status, body)
+	}
+
+	// the missing ones are waited for and downloaded first
+	type response struct {
+		status int
+		body   string
+	}
+	got := make(chan response, 1)
+	go func() {
+		status, body := getRange(t, url, "bytes=10-13")
+		got <- response{status, body}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for pr := mt.getPriority(); !pr.urgent(2); pr = mt.getPriority() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the read piece to be prioritized, got %+v", pr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	complete(2)
+	select {
+	case r := <-got:
+		t.Fatalf("Expected the read to wait for the last piece, got %d %q", r.status, r.body)
+	case <-time.After(3 * streamPollInterval):
+	}
+	complete(3)
+	select {
+	case r := <-got:
+		if r.status != http.StatusPartialContent || r.body != "abcd" {
+			t.Errorf("Expected abcd, got %d %q", r.status, r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the read to finish once downloaded")
+	}
+	if pr := mt.getPriority(); len(pr.reads) != 0 {
+		t.Errorf("Expected streaming to stop with the request")
+	}
+
+	// a stopped seed is read from its data
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mt.activate(StatePaused, nil, nil)
+	mt.seed(path, false)
+	if status, body := getRange(t, url, ""); status != http.StatusOK || body != string(data) {
+		t.Errorf("Expected the whole file, got %d %q", status, body)
+	}
+	if status, _ := getRange(t, c.FileURL(hash, 1), ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing file, got %d", status)
+	}
+}
+
+func TestStreamFileType(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef")
+	tf := testTorrent(data, 4)
+	tf.Name = "file.unknown-type"
+	tf.InfoHash = torrent.Sha1Hash{0x5f}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	mt, err := p.torrents.add(tf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := storage.NewMemoryStorage().Open(tf, tf.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the last piece is there, the type is not sniffed from the first one
+	st.WriteAt(data[12:], 3, 0)
+	st.MarkComplete(3)
+	mt.activate(StateDownloading, newSwarm(tf, st, p.PeerID, false), &DownloadSession{picker: testPicker(0, 1, 2)})
+
+	c := newControlServer(t, p)
+	req, err := http.NewRequest(http.MethodGet, c.FileURL(tf.InfoHash.String(), 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=12-15")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected the range to be served, got %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "cdef" {
+		t.Errorf("Expected cdef, got %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Expected application/octet-stream, got %q", ct)
+	}
+}
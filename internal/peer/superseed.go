@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+)
+
+// superSeeder implements super-seeding (BEP 16) for an initial seeder:
+// every peer sees an empty bitfield and is offered one piece at a time
+// with a Have message. A peer is only offered another piece once the
+// previous one is seen in a Have message from another peer, which means
+// it was passed on to the swarm instead of being uploaded by us again.
+type superSeeder struct {
+	mu        sync.Mutex
+	numPieces int
+	// how many peers announced each piece
+	availability []int
+	// how many times each piece was offered
+	offers []int
+	peers  map[*PeerConn]*superSeedPeer
+}
+
+type superSeedPeer struct {
+	has connection.BitField
+	// the piece offered to the peer, -1 if none
+	offered int
+	// every piece ever offered to the peer, the only ones it may request
+	allowed connection.BitField
+}
+
+// An offer of a piece to a peer, to be sent as a Have message
+type superSeedOffer struct {
+	conn  *PeerConn
+	piece int
+}
+
+func newSuperSeeder(numPieces int) *superSeeder {
+	return &superSeeder{
+		numPieces:    numPieces,
+		availability: make([]int, numPieces),
+		offers:       make([]int, numPieces),
+		peers:        make(map[*PeerConn]*superSeedPeer),
+	}
+}
+
+// add registers a peer and returns the first piece to offer it
+func (s *superSeeder) add(pc *PeerConn) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := &superSeedPeer{
+		has:     connection.NewBitField(s.numPieces),
+		offered: -1,
+		allowed: connection.NewBitField(s.numPieces),
+	}
+	s.peers[pc] = sp
+	return s.offerLocked(sp)
+}
+
+func (s *superSeeder) remove(pc *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, pc)
+}
+
+// offerLocked picks the rarest piece the peer does not have,
+// preferring pieces offered the least
+func (s *superSeeder) offerLocked(sp *superSeedPeer) (int, bool) {
+	best := -1
+	for i := 0; i < s.numPieces; i++ {
+		if sp.has.HasPiece(i) || sp.allowed.HasPiece(i) {
+			continue
+		}
+		if best == -1 || s.availability[i] < s.availability[best] ||
+			(s.availability[i] == s.availability[best] && s.offers[i] < s.offers[best]) {
+			best = i
+		}
+	}
+	if best == -1 {
+		sp.offered = -1
+		return 0, false
+	}
+	sp.offered = best
+	sp.allowed.SetPiece(best)
+	s.offers[best]++
+	return best, true
+}
+
+// have records that the peer announced a piece, and returns the new offers
+// for the peers whose offered piece has now been seen elsewhere
+func (s *superSeeder) have(pc *PeerConn, piece int) []superSeedOffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.peers[pc]
+	if !ok || piece < 0 || piece >= s.numPieces || sp.has.HasPiece(piece) {
+		return nil
+	}
+	sp.has.SetPiece(piece)
+	s.availability[piece]++
+
+	var offers []superSeedOffer
+	// with no one else to pass the piece on to, the only peer would starve
+	if sp.offered == piece && len(s.peers) == 1 {
+		if next, ok := s.offerLocked(sp); ok {
+			offers = append(offers, superSeedOffer{conn: pc, piece: next})
+		}
+	}
+	for other, op := range s.peers {
+		if other == pc || op.offered != piece {
+			continue
+		}
+		if next, ok := s.offerLocked(op); ok {
+			offers = append(offers, superSeedOffer{conn: other, piece: next})
+		}
+	}
+	return offers
+}
+
+// allowed reports whether the peer may request the piece
+func (s *superSeeder) allowed(pc *PeerConn, piece int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.peers[pc]
+	return ok && sp.allowed.HasPiece(piece)
+}
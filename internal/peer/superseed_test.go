@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"testing"
+)
+
+func TestSuperSeederOffersDistinctPieces(t *testing.T) {
+	s := newSuperSeeder(4)
+	a, b := &PeerConn{}, &PeerConn{}
+
+	pa, ok := s.add(a)
+	if !ok {
+		t.Fatalf("Expected a piece to be offered")
+	}
+	pb, ok := s.add(b)
+	if !ok {
+		t.Fatalf("Expected a piece to be offered")
+	}
+	if pa == pb {
+		t.Errorf("Expected different pieces to be offered, both got %d", pa)
+	}
+
+	if !s.allowed(a, pa) || s.allowed(a, pb) {
+		t.Errorf("Expected a peer to only be allowed its offered piece")
+	}
+}
+
+func TestSuperSeederWaitsForPropagation(t *testing.T) {
+	s := newSuperSeeder(4)
+	a, b := &PeerConn{}, &PeerConn{}
+	pa, _ := s.add(a)
+	pb, _ := s.add(b)
+
+	// a downloading its own piece is not enough
+	if offers := s.have(a, pa); len(offers) != 0 {
+		t.Errorf("Expected no offers before the piece propagates, got %v", offers)
+	}
+
+	// b got the piece of a, from a, so a gets a new piece
+	offers := s.have(b, pa)
+	if len(offers) != 1 || offers[0].conn != a {
+		t.Fatalf("Expected a new offer for a, got %v", offers)
+	}
+	if offers[0].piece == pa || offers[0].piece == pb {
+		t.Errorf("Expected a new rarest piece, got %d", offers[0].piece)
+	}
+
+	// announcing twice does not count twice
+	if offers := s.have(b, pa); len(offers) != 0 {
+		t.Errorf("Expected no offers for a repeated have, got %v", offers)
+	}
+}
+
+func TestSuperSeederSinglePeer(t *testing.T) {
+	s := newSuperSeeder(2)
+	a := &PeerConn{}
+	p, _ := s.add(a)
+
+	offers := s.have(a, p)
+	if len(offers) != 1 || offers[0].piece == p {
+		t.Fatalf("Expected the only peer to be offered the next piece, got %v", offers)
+	}
+
+	// nothing left to offer
+	if offers := s.have(a, offers[0].piece); len(offers) != 0 {
+		t.Errorf("Expected no offers once the peer has everything, got %v", offers)
+	}
+
+	s.remove(a)
+	if s.allowed(a, p) {
+		t.Errorf("Expected removed peer to not be allowed anything")
+	}
+}
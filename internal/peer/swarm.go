@@ -0,0 +1,173 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"sync"
+
+	"github.com/chezzijr/p2p/internal/common/connection"
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+// swarm is an active torrent and its connections, one per remote peer,
+// the data may still be downloading
+type swarm struct {
+	*torrent.TorrentFile
+	data    storage.Torrent
+	localID [20]byte
+	// whether pieces are uploaded, always when seeding and
+	// while downloading only when seeding on piece downloaded
+	upload bool
+	// nil unless super-seeding
+	superSeed *superSeeder
+	// shared with the other sessions of the torrent
+	counters *torrentCounters
+
+	// the info dictionary sent for magnet links
+	metadataOnce sync.Once
+	info         []byte
+
+	mu    sync.Mutex
+	conns map[[20]byte]*PeerConn
+	// no connection is added once closed
+	closed bool
+	// called with every connection while downloading
+	onConn func(*PeerConn)
+}
+
+func newSwarm(tf *torrent.TorrentFile, data storage.Torrent, localID [20]byte, upload bool) *swarm {
+	return &swarm{
+		TorrentFile: tf,
+		data:        data,
+		localID:     localID,
+		upload:      upload,
+		counters:    &torrentCounters{},
+		conns:       make(map[[20]byte]*PeerConn),
+	}
+}
+
+// metadata returns the bencoded info dictionary, nil when encoding
+// the metainfo does not give back the info hash
+func (s *swarm) metadata() []byte {
+	s.metadataOnce.Do(func() {
+		info, err := s.InfoBytes()
+		if err != nil || sha1.Sum(info) != s.InfoHash {
+			return
+		}
+		s.info = info
+	})
+	return s.info
+}
+
+// initiator is the ID of the peer that opened the connection
+func (s *swarm) initiator(pc *PeerConn) [20]byte {
+	if pc.Outbound() {
+		return s.localID
+	}
+	return pc.RemoteID
+}
+
+// add registers a connection, when both peers connected to each other
+// the connection opened by the peer with the lower ID is kept on both sides
+func (s *swarm) add(pc *PeerConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrConnClosed
+	}
+	existing, ok := s.conns[pc.RemoteID]
+	if ok {
+		a, b := s.initiator(existing), s.initiator(pc)
+		if bytes.Compare(a[:], b[:]) <= 0 {
+			s.mu.Unlock()
+			return ErrDuplicateConn
+		}
+	}
+	s.conns[pc.RemoteID] = pc
+	onConn := s.onConn
+	s.mu.Unlock()
+
+	if ok {
+		existing.Close()
+	}
+	if onConn != nil {
+		onConn(pc)
+	}
+	return nil
+}
+
+func (s *swarm) remove(pc *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[pc.RemoteID] == pc {
+		delete(s.conns, pc.RemoteID)
+	}
+}
+
+// connectedTo reports whether there is a connection we opened to the address
+func (s *swarm) connectedTo(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pc := range s.conns {
+		if pc.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// setOnConn sets the callback for the current and future connections
+func (s *swarm) setOnConn(fn func(*PeerConn)) {
+	s.mu.Lock()
+	s.onConn = fn
+	conns := make([]*PeerConn, 0, len(s.conns))
+	for _, pc := range s.conns {
+		conns = append(conns, pc)
+	}
+	s.mu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	for _, pc := range conns {
+		fn(pc)
+	}
+}
+
+// advertisedBitfield is the bitfield sent to new connections
+func (s *swarm) advertisedBitfield() connection.BitField {
+	// super-seeding hides the pieces, they are offered one by one
+	if !s.upload || s.superSeed != nil {
+		return connection.NewBitField(s.NumPieces())
+	}
+	return s.data.Completed()
+}
+
+// broadcastHave tells every connected peer that a new piece is available
+func (s *swarm) broadcastHave(index int) {
+	if !s.upload {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pc := range s.conns {
+		pc.sendHave(index)
+	}
+}
+
+// close disconnects every connected peer
+func (s *swarm) close() {
+	s.mu.Lock()
+	conns := make([]*PeerConn, 0, len(s.conns))
+	for _, pc := range s.conns {
+		conns = append(conns, pc)
+	}
+	s.onConn = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/chezzijr/p2p/internal/peer/storage"
+)
+
+// countingStorage counts the reads reaching the storage below the cache
+type countingStorage struct {
+	storage.Storage
+	reads atomic.Int64
+}
+
+func (s *countingStorage) Open(t *torrent.TorrentFile, path string) (storage.Torrent, error) {
+	data, err := s.Storage.Open(t, path)
+	if err != nil {
+		return nil, err
+	}
+	return &countingTorrent{Torrent: data, reads: &s.reads}, nil
+}
+
+type countingTorrent struct {
+	storage.Torrent
+	reads *atomic.Int64
+}
+
+func (t *countingTorrent) ReadAt(b []byte, piece int, begin int) (int, error) {
+	t.reads.Add(1)
+	return t.Torrent.ReadAt(b, piece, begin)
+}
+
+func TestGetPiece(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	tf := testTorrent(data, 8)
+	backend := &countingStorage{Storage: storage.NewMemoryStorage()}
+	st := storage.NewDiskIO(backend, storage.DiskIOConfig{ReadCacheSize: 64})
+	defer st.Close()
+	torrentData, err := st.Open(tf, "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer torrentData.Close()
+	for i := 0; i < tf.NumPieces(); i++ {
+		begin, end := tf.PieceBounds(i)
+		torrentData.WriteAt(data[begin:end], i, 0)
+		torrentData.MarkComplete(i)
+	}
+	if err := torrentData.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	pc := newPeerConn(a, newSwarm(tf, torrentData, [20]byte{1}, true), [20]byte{2}, "", newChoker(realClock{}, 1))
+
+	// nothing is read until a block is requested
+	if n := backend.reads.Load(); n != 0 {
+		t.Errorf("Expected no reads before a request, got %d", n)
+	}
+	// the piece is read once, the other blocks come from the read cache
+	for _, begin := range []uint32{0, 4, 2} {
+		buf, err := pc.getPiece(1, begin, 4)
+		if err != nil {
+			t.Fatalf("Failed to get block at %d: %s", begin, err)
+		}
+		if want := data[8+begin : 12+begin]; !bytes.Equal(buf[8:], want) {
+			t.Errorf("Expected %q, got %q", want, buf[8:])
+		}
+	}
+	if n := backend.reads.Load(); n != 1 {
+		t.Errorf("Expected the piece to be read once, got %d reads", n)
+	}
+
+	// invalid requests fail before allocating the block
+	invalid := []struct{ index, begin, length uint32 }{
+		{2, 0, 4},
+		{0, 6, 4},
+		{0, 0xffffffff, 4},
+		{0, 0, MaxBlockSize + 1},
+		{0, 0, 0xffffffff},
+	}
+	for _, r := range invalid {
+		if _, err := pc.getPiece(r.index, r.begin, r.length); err != ErrOutOfBound {
+			t.Errorf("Expected ErrOutOfBound for %+v, got %v", r, err)
+		}
+		allocs := testing.AllocsPerRun(10, func() { pc.getPiece(r.index, r.begin, r.length) })
+		if allocs != 0 {
+			t.Errorf("Expected no allocation for %+v, got %v", r, allocs)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+	"github.com/fsnotify/fsnotify"
+)
+
+// A file is imported once it has not changed for this long,
+// it may still be copied when it is created
+const watchSettleDelay = 500 * time.Millisecond
+
+// Suffix of the files that could not be imported, they are not tried again
+const invalidTorrentSuffix = ".invalid"
+
+// archiveDir is where the imported files are moved
+func (p *Peer) archiveDir() string {
+	if p.config.WatchArchiveDir != "" {
+		return p.config.WatchArchiveDir
+	}
+	return filepath.Join(p.config.WatchDir, "archive")
+}
+
+// watchLoop downloads the torrent files dropped in the directory until the context is done
+func (p *Peer) watchLoop(ctx context.Context, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// the directory may be configured before it exists
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+
+	// last change of the files not imported yet
+	pending := make(map[string]time.Time)
+	// the files dropped while the peer was not running
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isTorrentFile(entry.Name()) {
+			pending[filepath.Join(dir, entry.Name())] = time.Time{}
+		}
+	}
+
+	ticker := time.NewTicker(watchSettleDelay / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			logger.Error("Failed to watch directory", "dir", dir, "error", err)
+		case ev := <-watcher.Events:
+			if !isTorrentFile(ev.Name) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) {
+				pending[ev.Name] = time.Now()
+			} else if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				delete(pending, ev.Name)
+			}
+		case now := <-ticker.C:
+			for path, changed := range pending {
+				if now.Sub(changed) < watchSettleDelay {
+					continue
+				}
+				delete(pending, path)
+				e, err := p.importTorrent(path)
+				if err != nil {
+					logger.Error("Failed to import torrent", "file", path, "error", err)
+					continue
+				}
+				select {
+				case p.events <- e:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func isTorrentFile(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".torrent")
+}
+
+// importTorrent moves a dropped torrent file to the archive and returns the event downloading it,
+// an invalid file is renamed so that it is reported once, a duplicate is left in place
+func (p *Peer) importTorrent(path string) (*EventDownload, error) {
+	tf, err := torrent.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		if rerr := os.Rename(path, path+invalidTorrentSuffix); rerr != nil {
+			return nil, rerr
+		}
+		return nil, fmt.Errorf("Invalid torrent file: %w", err)
+	}
+
+	if _, ok := p.torrents.get(tf.InfoHash); ok {
+		return nil, fmt.Errorf("%w: %s", ErrTorrentExists, tf.InfoHash)
+	}
+	archived, err := archiveFile(path, p.archiveDir())
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Importing torrent", "file", path, "name", tf.Name)
+	return &EventDownload{
+		DownloadPath: p.config.WatchDownloadDir,
+		TorrentPath:  archived,
+	}, nil
+}
+
+// archiveFile moves the file to the directory without replacing another file
+func archiveFile(path, dir string) (string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	dest := filepath.Join(dir, name)
+	if _, err := os.Stat(dest); err == nil {
+		ext := filepath.Ext(name)
+		dest = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), time.Now().UnixNano(), ext))
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
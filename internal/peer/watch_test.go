@@ -0,0 +1,134 @@
+package peer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chezzijr/p2p/internal/common/torrent"
+)
+
+func TestWatchDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tf := testTorrent([]byte("0123456789"), 4)
+	tf.Announce = "http://localhost/announce"
+	// dropped before the peer started
+	if err := tf.Save(filepath.Join(watchDir, "before.torrent")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	p.events = make(chan Event, 2)
+	p.config.WatchDir = watchDir
+	p.config.WatchDownloadDir = filepath.Join(dir, "downloads")
+	watched := make(chan error, 1)
+	go func() { watched <- p.watchLoop(ctx, watchDir) }()
+
+	expectImport := func(name string) {
+		t.Helper()
+		select {
+		case e := <-p.events:
+			ed, ok := e.(*EventDownload)
+			if !ok {
+				t.Fatalf("Expected a download event, got %T", e)
+			}
+			if want := filepath.Join(watchDir, "archive", name); ed.TorrentPath != want {
+				t.Errorf("Expected the torrent to be archived to %s, got %s", want, ed.TorrentPath)
+			}
+			if ed.DownloadPath != p.config.WatchDownloadDir {
+				t.Errorf("Expected the download to %s, got %s", p.config.WatchDownloadDir, ed.DownloadPath)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s to be imported", name)
+		}
+	}
+	expectImport("before.torrent")
+
+	if err := os.WriteFile(filepath.Join(watchDir, "bad.torrent"), []byte("not bencode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Save(filepath.Join(watchDir, "after.torrent")); err != nil {
+		t.Fatal(err)
+	}
+	expectImport("after.torrent")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(watchDir, "bad.torrent"+invalidTorrentSuffix)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the invalid file to be renamed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(watchDir, "before.torrent")); !os.IsNotExist(err) {
+		t.Errorf("Expected the imported file to be moved, got %v", err)
+	}
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("Expected the watch to stop cleanly, got %s", err)
+	}
+}
+
+func TestWatchDirDuplicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	// created by the watch
+	watchDir := filepath.Join(dir, "watch")
+	saved := filepath.Join(dir, "dup.torrent")
+	if err := testTorrent([]byte("0123456789"), 4).Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrent.Open(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPeer(t, filepath.Join(dir, "cache.json"))
+	p.events = make(chan Event, 1)
+	p.config.WatchDir = watchDir
+	if _, err := p.torrents.add(tf, dir); err != nil {
+		t.Fatal(err)
+	}
+	watched := make(chan error, 1)
+	go func() { watched <- p.watchLoop(ctx, watchDir) }()
+
+	path := filepath.Join(watchDir, "dup.torrent")
+	deadline := time.Now().Add(5 * time.Second)
+	for os.Rename(saved, path) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the watch directory to be created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the duplicate is reported and left in place
+	select {
+	case e := <-p.events:
+		t.Fatalf("Expected the duplicate not to be imported, got %T", e)
+	case <-time.After(4 * watchSettleDelay):
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the duplicate to be left in place, got %v", err)
+	}
+	if _, err := os.Stat(p.archiveDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be archived, got %v", err)
+	}
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("Expected the watch to stop cleanly, got %s", err)
+	}
+}